@@ -0,0 +1,145 @@
+package concrete
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/device"
+)
+
+// The number of blocks which are not free
+func usedBlocks(fSys *fileSystemImpl) int64 {
+	return fSys.sizeInBytes/_BlockSize - fSys.numberFreeNodes
+}
+
+// Writes the string at the offset of the file
+func writeAtOffset(t *testing.T, fs gofs.FileSystem, name string, offset int64, s string) {
+	t.Helper()
+
+	file := fs.Open(name)
+	file.Seek(offset, int(gofs.Beginning))
+	if _, err := file.Write([]byte(s)); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+}
+
+func TestClone_CopyOnWrite(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	contents := strings.Repeat("a", 3*_DataSize)
+	writeFile(t, fs, "src", contents)
+	used := usedBlocks(fSys)
+
+	// Nothing is copied by the clone itself
+	if err := fs.Clone("src", "dst"); err != nil {
+		t.Fatal(err)
+	} else if usedBlocks(fSys) != used {
+		t.Fatalf("clone used %d blocks", usedBlocks(fSys)-used)
+	} else if got := readFile(t, fs, "dst"); got != contents {
+		t.Fatal("clone differs from the source")
+	}
+
+	// Writing the second block copies it and the block before it
+	writeAtOffset(t, fs, "dst", _DataSize, "dst")
+	if usedBlocks(fSys) != used+2 {
+		t.Errorf("write used %d blocks, want 2", usedBlocks(fSys)-used)
+	}
+	if got := readFile(t, fs, "src"); got != contents {
+		t.Error("write to the clone changed the source")
+	}
+
+	// The first block of the source is its own again, the last is
+	// still shared
+	writeAtOffset(t, fs, "src", 0, "src")
+	if usedBlocks(fSys) != used+2 {
+		t.Errorf("write to the source copied %d blocks", usedBlocks(fSys)-used-2)
+	}
+	if got := readFile(t, fs, "dst"); got[:3] != "aaa" || got[_DataSize:_DataSize+3] != "dst" {
+		t.Error("write to the source changed the clone")
+	} else if fSys.refCount(fSys.files["src"].last) != 2 {
+		t.Error("last block is no longer shared")
+	}
+	checkBlocks(t, fSys)
+}
+
+func TestClone_Release(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	writeFile(t, fs, "src", strings.Repeat("a", 3*_DataSize))
+	used := usedBlocks(fSys)
+	fs.Clone("src", "dst")
+	writeAtOffset(t, fs, "dst", _DataSize, "dst")
+
+	// The blocks shared with the clone are kept
+	if err := fs.Delete("src"); err != nil {
+		t.Fatal(err)
+	} else if usedBlocks(fSys) != used {
+		t.Errorf("%d blocks in use after deleting the source, want %d", usedBlocks(fSys), used)
+	}
+	checkBlocks(t, fSys)
+
+	if err := fs.Delete("dst"); err != nil {
+		t.Fatal(err)
+	} else if usedBlocks(fSys) != 0 {
+		t.Errorf("%d blocks in use after deleting both", usedBlocks(fSys))
+	} else if len(fSys.refs) != 0 {
+		t.Errorf("%d reference counts left", len(fSys.refs))
+	}
+}
+
+func TestClone_Errors(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeFile(t, fs, "a", "a")
+	writeFile(t, fs, "b", "b")
+
+	if err := fs.Clone("missing", "c"); err == nil {
+		t.Error("cloned a file which does not exist")
+	} else if err = fs.Clone("a", "b"); err == nil {
+		t.Error("cloned over an existing file")
+	} else if err = fs.Clone("a", ""); err == nil {
+		t.Error("cloned to an empty name")
+	} else if got := readFile(t, fs, "b"); got != "b" {
+		t.Errorf("b is %q after a failed clone", got)
+	}
+}
+
+func TestClone_Fails(t *testing.T) {
+	disk := device.NewFaultyDisk()
+	fs, err := Open("", "clone", Storage(disk.Open))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	writeFile(t, fs, "src", strings.Repeat("a", 3*_DataSize))
+	used, owned := usedBlocks(fSys), fSys.files["src"].owned
+
+	disk.Inject(device.FailAt(device.OpWrite, disk.Count(device.OpWrite)+1, errInjected))
+	if err = fs.Clone("src", "dst"); err != errInjected {
+		t.Fatalf("clone returned %v", err)
+	} else if fs.Exists("dst") {
+		t.Error("failed clone exists")
+	} else if len(fSys.refs) != 0 {
+		t.Errorf("%d reference counts left by a failed clone", len(fSys.refs))
+	}
+
+	// The source still owns its blocks and writes to them in place
+	if fSys.files["src"].owned != owned {
+		t.Errorf("source owns %d blocks after a failed clone, want %d", fSys.files["src"].owned, owned)
+	}
+	writeAtOffset(t, fs, "src", 0, "c")
+	if usedBlocks(fSys) != used {
+		t.Errorf("write after a failed clone used %d blocks", usedBlocks(fSys)-used)
+	}
+	checkBlocks(t, fSys)
+}
@@ -0,0 +1,216 @@
+package concrete
+
+// CompactProgress describes how far a compaction has got
+type CompactProgress struct {
+	Moved int64 // number of blocks written so far
+	Total int64 // number of blocks to write, twice the number in use
+}
+
+// Returns every file whose blocks may be moved.  Files in the name
+// table come first, in name order, so they are laid out together.
+func (fSys *fileSystemImpl) compactHeads() []*fileInfo {
+	var result []*fileInfo
+	seen := make(map[*fileInfo]bool)
+
+	add := func(info *fileInfo) {
+		if info != nil && !seen[info] {
+			seen[info] = true
+			result = append(result, info)
+		}
+	}
+
+	for _, name := range sortedNames(fSys.files) {
+		add(fSys.files[name])
+	}
+	for _, snap := range fSys.sortedSnapshots() {
+		for _, name := range sortedNames(snap.files) {
+			add(snap.files[name])
+		}
+	}
+	for _, name := range sortedVersionNames(fSys.versions) {
+		for _, v := range fSys.versions[name].versions {
+			add(v.info)
+		}
+	}
+	for t := range fSys.transactions {
+		for _, info := range t.files {
+			add(info)
+		}
+	}
+	for info := range fSys.openFiles {
+		add(info)
+	}
+
+	// Open snapshots use the blocks of the snapshot, they only need
+	// their pointers updated
+	for view := range fSys.views {
+		for _, info := range view.files {
+			add(info)
+		}
+		for info := range view.openFiles {
+			add(info)
+		}
+	}
+
+	return result
+}
+
+// Gives every block in use its new index.  The blocks of each file
+// are numbered in chain order, blocks shared with a file seen before
+// keep the number they were given then.
+func (fSys *fileSystemImpl) compactLayout(heads []*fileInfo) (map[int64]int64, []int64, error) {
+	moves := make(map[int64]int64)
+	var order []int64
+
+	for _, info := range heads {
+		for curr := info.first; curr != _NullIndex; {
+			if _, seen := moves[curr]; seen {
+				break
+			}
+			moves[curr] = int64(len(order))
+			order = append(order, curr)
+
+			node, err := fSys.getBlock(curr)
+			if err != nil {
+				return nil, nil, err
+			}
+			curr = node.next
+		}
+	}
+	return moves, order, nil
+}
+
+// Compact moves the blocks of each file next to each other at the
+// start of the data file, then shrinks the data file to the blocks in
+// use and the name file to the name table.  The lock is held for the
+// whole run so every other call waits for it, open handles can be
+// used again once it returns.
+//
+// The blocks are copied past the end of the data file and the name
+// table committed before they are moved to the start, so a crash part
+// way through leaves one layout or the other.
+//
+// If progress is not nil it is called after each block is written,
+// it must not use the file system.
+func (fSys *fileSystemImpl) Compact(progress func(CompactProgress)) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	}
+
+	heads := fSys.compactHeads()
+	moves, order, err := fSys.compactLayout(heads)
+	if err != nil {
+		return err
+	}
+
+	end := fSys.sizeInBytes / _BlockSize
+	count := int64(len(order))
+	report := CompactProgress{Total: 2 * count}
+
+	// The blocks are first copied past the end of the data file, in
+	// their new order, and the name table is pointed at the copies.
+	// Nothing in use is overwritten so a crash leaves either the old
+	// blocks or the copies.
+	if err = fSys.dataFile.Grow((end + count) * _BlockSize); err != nil {
+		return err
+	}
+
+	toCopy := func(index int64) int64 {
+		if moved, exists := moves[index]; exists {
+			return end + moved
+		}
+		return _NullIndex
+	}
+	for _, index := range order {
+		if err = fSys.compactMove(index, toCopy, progress, &report); err != nil {
+			return err
+		}
+	}
+
+	// Blocks freed since the table was written are not in use, they
+	// are dropped with the rest of the old blocks
+	fSys.freed = nil
+	fSys.relocate(heads, toCopy, (end+count)*_BlockSize)
+	if err = fSys.writeNames(); err != nil {
+		return err
+	}
+
+	// Then the copies are moved to the start, over blocks which are
+	// no longer in use
+	toStart := func(index int64) int64 {
+		if index == _NullIndex {
+			return _NullIndex
+		}
+		return index - end
+	}
+	for index := end; index < end+count; index++ {
+		if err = fSys.compactMove(index, toStart, progress, &report); err != nil {
+			return err
+		}
+	}
+
+	fSys.relocate(heads, toStart, count*_BlockSize)
+	names := fSys.encodeNames()
+	if err = fSys.commitNames(names); err != nil {
+		return err
+	} else if err = fSys.nameFile.Truncate(int64(len(names))); err != nil {
+		return err
+	}
+	return fSys.dataFile.Truncate(fSys.sizeInBytes)
+}
+
+// Writes the block to the index remap gives it, with its links
+// remapped too
+func (fSys *fileSystemImpl) compactMove(index int64, remap func(int64) int64, progress func(CompactProgress), report *CompactProgress) error {
+	node, err := fSys.getBlock(index)
+	if err != nil {
+		return err
+	}
+
+	node.id, node.prev, node.next = remap(index), remap(node.prev), remap(node.next)
+	if err = fSys.writeNode(node); err != nil {
+		return err
+	}
+
+	report.Moved++
+	if progress != nil {
+		progress(*report)
+	}
+	return nil
+}
+
+// Points the files and the reference counts at the blocks' new
+// places.  Every block past the ones in use was free so the free
+// list is left empty.
+func (fSys *fileSystemImpl) relocate(heads []*fileInfo, remap func(int64) int64, size int64) {
+	for _, info := range heads {
+		info.first, info.last = remap(info.first), remap(info.last)
+		if info.owned > 0 {
+			info.ownedTail = remap(info.ownedTail)
+		}
+	}
+
+	refs := make(map[int64]int64, len(fSys.refs))
+	for index, count := range fSys.refs {
+		refs[remap(index)] = count
+	}
+	fSys.refs = refs
+
+	for info := range fSys.openFiles {
+		fSys.invalidate(info)
+	}
+
+	fSys.indexOfFirstFree = _NullIndex
+	fSys.indexOfLastFree = _NullIndex
+	fSys.numberFreeNodes = 0
+	fSys.sizeInBytes = size
+
+	for view := range fSys.views {
+		for info := range view.openFiles {
+			view.invalidate(info)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+package concrete
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Writes files of different sizes and deletes every third one so the
+// free blocks are spread between the files that are left
+func fragment(t *testing.T, fs FileSystem) map[string]string {
+	files := make(map[string]string)
+	for i := 0; i < 12; i++ {
+		name := fmt.Sprint("f", i)
+		files[name] = strings.Repeat(name, (i%4+1)*_DataSize/2)
+		writeFile(t, fs, name, files[name])
+	}
+
+	for i := 0; i < 12; i += 3 {
+		name := fmt.Sprint("f", i)
+		if err := fs.Delete(name); err != nil {
+			t.Fatal(err)
+		}
+		delete(files, name)
+	}
+	return files
+}
+
+func TestCompact_Layout(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	fSys := fs.(*fileSystemImpl)
+	files := fragment(t, fs)
+	if fSys.numberFreeNodes == 0 {
+		t.Fatal("nothing to compact")
+	}
+
+	if err := fs.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, fSys)
+
+	// Each file follows the one before it in name order
+	next := int64(0)
+	for _, name := range sortedNames(fSys.files) {
+		info := fSys.files[name]
+		for curr := info.first; curr != _NullIndex; next++ {
+			if curr != next {
+				t.Fatalf("%s uses block %d, want %d", name, curr, next)
+			}
+
+			node, err := fSys.getBlock(curr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			curr = node.next
+		}
+	}
+
+	if fSys.numberFreeNodes != 0 {
+		t.Errorf("%d free blocks after compacting", fSys.numberFreeNodes)
+	} else if fSys.sizeInBytes != next*_BlockSize {
+		t.Errorf("data file holds %d bytes of blocks, want %d", fSys.sizeInBytes, next*_BlockSize)
+	} else if size := fSys.dataFile.Size(); size != fSys.sizeInBytes {
+		t.Errorf("data file is %d bytes, want %d", size, fSys.sizeInBytes)
+	}
+
+	for name, want := range files {
+		if got := readFile(t, fs, name); got != want {
+			t.Errorf("%s differs after compacting", name)
+		}
+	}
+}
+
+func TestCompact_Contents(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := Open(dir, "compact", Versioned())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := fragment(t, fs)
+	if err = fs.Clone("f1", "clone"); err != nil {
+		t.Fatal(err)
+	}
+	files["clone"] = files["f1"]
+	if err = fs.Snapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	snapped := files["f2"]
+	files["f2"] = "changed" + files["f2"][7:]
+	writeFile(t, fs, "f2", files["f2"])
+
+	handle := fs.Open("f4")
+	view, err := fs.OpenSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = fs.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+
+	for name, want := range files {
+		if got := readFile(t, fs, name); got != want {
+			t.Errorf("%s differs after compacting", name)
+		}
+	}
+	if got := readFile(t, view, "f2"); got != snapped {
+		t.Error("snapshot differs after compacting")
+	}
+	view.Shutdown(context.Background())
+
+	versions := fs.Versions("f1")
+	if len(versions) == 0 {
+		t.Fatal("no versions of f1")
+	}
+	version, err := fs.OpenVersion("f1", versions[0].Number)
+	if err != nil {
+		t.Fatal(err)
+	} else if got := readAll(t, version); got != files["f1"] {
+		t.Error("version differs after compacting")
+	}
+	version.Close()
+
+	// Handles opened before are still usable
+	if got := readAll(t, handle); got != files["f4"] {
+		t.Error("open handle reads different contents after compacting")
+	} else if _, err = handle.Write([]byte("more")); err != nil {
+		t.Fatal(err)
+	}
+	handle.Close()
+	files["f4"] += "more"
+
+	if err = fs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if fs, err = Open(dir, "compact"); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	checkBlocks(t, fs.(*fileSystemImpl))
+	for name, want := range files {
+		if got := readFile(t, fs, name); got != want {
+			t.Errorf("%s differs after opening again", name)
+		}
+	}
+}
+
+func TestCompact_Progress(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	fragment(t, fs)
+	fSys := fs.(*fileSystemImpl)
+	used := fSys.sizeInBytes/_BlockSize - fSys.numberFreeNodes
+
+	var reports []CompactProgress
+	err := fs.Compact(func(p CompactProgress) {
+		reports = append(reports, p)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Every block in use is written twice
+	if int64(len(reports)) != 2*used {
+		t.Fatalf("%d reports for %d blocks in use", len(reports), used)
+	}
+	for i, report := range reports {
+		if report.Moved != int64(i+1) || report.Total != 2*used {
+			t.Fatalf("report %d is %+v, want %d of %d", i, report, i+1, 2*used)
+		}
+	}
+}
@@ -5,13 +5,13 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"path"
+	"sort"
 	"time"
-    "os"
 
-	"github.com/deathly809/goassert"
 	"github.com/deathly809/gofs"
-	"github.com/deathly809/gofs/mmap"
+	"github.com/deathly809/gofs/device"
 	"github.com/deathly809/gomath"
 )
 
@@ -19,6 +19,27 @@ const (
 	_GrowFactor = 1024
 )
 
+// Read len(data) bytes from the device starting at offset
+func readAt(dev device.BlockDevice, data []byte, offset int64) error {
+	n, err := dev.ReadAt(data, offset)
+	if n == len(data) {
+		return nil
+	} else if err == nil || err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Write all of data to the device starting at offset
+func writeAt(dev device.BlockDevice, data []byte, offset int64) error {
+	if n, err := dev.WriteAt(data, offset); err != nil {
+		return err
+	} else if n != len(data) {
+		return io.ErrShortWrite
+	}
+	return nil
+}
+
 // Read the name file for the header information
 func (fSys *fileSystemImpl) readHeader() error {
 	header := make([]byte, _HeaderSize)
@@ -26,17 +47,14 @@ func (fSys *fileSystemImpl) readHeader() error {
 
 	buffer := bytes.NewReader(header)
 
-	fSys.nameFile.Seek(0, os.SEEK_SET)
-	if n, err := fSys.nameFile.Read(header); err != nil {
+	if err := readAt(fSys.nameFile, header, 0); err != nil {
 		return err
-	} else if n != _HeaderSize {
-		return fmt.Errorf("incorrect header size: %d", n)
 	}
 
 	if n, err := buffer.Read(signature); err != nil {
 		return err
-	} else if n != _SignatureSize {
-		return fmt.Errorf("signature mismatch: %s", signature[:n])
+	} else if n != _SignatureSize || !bytes.Equal(signature, _Signature) {
+		return fmt.Errorf("signature mismatch: %x", signature[:n])
 	}
 
 	var major, minor, patch int32
@@ -54,6 +72,7 @@ func (fSys *fileSystemImpl) readHeader() error {
 		msg := fmt.Sprintf("Trying to load an incompatible filesystem version: %d.%d.%d", major, minor, patch)
 		return errors.New(msg)
 	}
+	fSys.minor = minor
 
 	if err := binary.Read(buffer, binary.BigEndian, &fSys.numFiles); err != nil {
 		return err
@@ -66,199 +85,866 @@ func (fSys *fileSystemImpl) readHeader() error {
 	if err := binary.Read(buffer, binary.BigEndian, &fSys.indexOfFirstFree); err != nil {
 		return err
 	}
+
+	if err := binary.Read(buffer, binary.BigEndian, &fSys.numberFreeNodes); err != nil {
+		return err
+	}
 	return nil
 }
 
-// given a block index we read the file
-func (fSys *fileSystemImpl) readFile(pos int) fileNode { // int
-	length := _BlockSize
-	ptr := fSys.rawData[pos:length]
-	reader := bytes.NewReader(ptr)
-
-	result := fileNode{}
-	binary.Read(reader, binary.BigEndian, &result.prev)
-	binary.Read(reader, binary.BigEndian, &result.next)
-	result.data = ptr[8:]
+// Converts the header information to bytes
+func (fSys *fileSystemImpl) encodeHeader() []byte {
+	var buffer bytes.Buffer
+	buffer.Write(_Signature)
+
+	fields := []interface{}{
+		Major, Minor, Patch,
+		fSys.numFiles,
+		fSys.sizeInBytes,
+		fSys.indexOfFirstFree,
+		fSys.numberFreeNodes,
+	}
+	for _, field := range fields {
+		binary.Write(&buffer, binary.BigEndian, field)
+	}
 
-	return result
+	header := make([]byte, _HeaderSize)
+	copy(header, buffer.Bytes())
+	return header
 }
 
 // Given some data convert it to fileInfo
-func parseFileInfo(data []byte) fileInfo {
-	result := fileInfo{}
-	result.name = ""
-	result.size = 0
+func parseFileInfo(data []byte) (*fileInfo, error) {
+	if len(data) < _EntrySize {
+		return nil, fmt.Errorf("incorrect entry size: %d", len(data))
+	}
+
+	reader := bytes.NewReader(data)
+
+	name, err := readName(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &fileInfo{}
+	result.name = name
+
+	var lastModified, created int64
+	fields := []interface{}{&result.size, &result.first, &result.last, &lastModified, &created}
+	for _, field := range fields {
+		if err := binary.Read(reader, binary.BigEndian, field); err != nil {
+			return nil, err
+		}
+	}
 
-	result.lastModified = time.Now()
-	result.created = time.Now()
+	result.lastModified = time.Unix(0, lastModified)
+	result.created = time.Unix(0, created)
 
-	result.first = 0
-	result.last = 0
+	return result, nil
+}
 
+// Converts a name into its length followed by the name padded
+// to _NameSize bytes
+func encodeName(name string) []byte {
+	result := make([]byte, _NameLength+_NameSize)
+	binary.BigEndian.PutUint16(result, uint16(len(name)))
+	copy(result[_NameLength:], name)
 	return result
 }
 
+// Reads a name written by encodeName
+func readName(reader io.Reader) (string, error) {
+	var nameLength uint16
+	if err := binary.Read(reader, binary.BigEndian, &nameLength); err != nil {
+		return "", err
+	} else if nameLength == 0 || nameLength > _NameSize {
+		return "", fmt.Errorf("incorrect name length: %d", nameLength)
+	}
+
+	name := make([]byte, _NameSize)
+	if _, err := io.ReadFull(reader, name); err != nil {
+		return "", err
+	}
+	return string(name[:nameLength]), nil
+}
+
+// Returns the names of the files in sorted order
+func sortedNames(files map[string]*fileInfo) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the names of the files with versions in sorted order
+func sortedVersionNames(versions map[string]*history) []string {
+	names := make([]string, 0, len(versions))
+	for name := range versions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Converts fileInfo into an entry of the name file
+func encodeFileInfo(info *fileInfo) []byte {
+	var buffer bytes.Buffer
+
+	buffer.Write(encodeName(info.name))
+
+	fields := []interface{}{
+		info.size,
+		info.first,
+		info.last,
+		info.lastModified.UnixNano(),
+		info.created.UnixNano(),
+	}
+	for _, field := range fields {
+		binary.Write(&buffer, binary.BigEndian, field)
+	}
+
+	return buffer.Bytes()
+}
+
 // Read the name file
 func (fSys *fileSystemImpl) loadFiles() error {
-	bytes := fSys.nameFile.Bytes()
+	reader := &nameReader{fSys.nameFile, _HeaderSize}
+	if err := reader.fits(fSys.numFiles, _EntrySize, "files"); err != nil {
+		return err
+	}
+
+	entry := make([]byte, _EntrySize)
 	for i := int64(0); i < fSys.numFiles; i++ {
-		//
-		fSys.files[""] = parseFileInfo(bytes[_HeaderSize*i : _HeaderSize])
+		if err := readAt(fSys.nameFile, entry, _HeaderSize+i*_EntrySize); err != nil {
+			return err
+		}
+
+		info, err := parseFileInfo(entry)
+		if err != nil {
+			return err
+		}
+		fSys.files[info.name] = info
+	}
+
+	// Snapshots were added in 0.2
+	if fSys.minor < 2 {
+		return nil
+	}
+	reader.offset += fSys.numFiles * _EntrySize
+	return fSys.loadExtras(reader)
+}
+
+// The sizes of the records which follow the file entries, not
+// counting the entries they hold
+const (
+	_SnapshotSize = _NameLength + _NameSize + 16 // name, created and number of files
+	_RefSize      = 16                           // block index and count
+	_HistorySize  = _NameLength + _NameSize + 16 // name, latest and number of versions
+	_VersionSize  = 16 + _EntrySize              // number, recorded and entry
+)
+
+// Reads the name file sequentially starting from an offset
+type nameReader struct {
+	file   device.BlockDevice
+	offset int64
+}
+
+func (reader *nameReader) Read(data []byte) (int, error) {
+	if err := readAt(reader.file, data, reader.offset); err != nil {
+		return 0, err
+	}
+	reader.offset += int64(len(data))
+	return len(data), nil
+}
+
+// Checks that count records of at least size bytes each fit in what
+// is left of the name file, so a damaged count cannot make a load
+// loop for longer than the file could describe
+func (reader *nameReader) fits(count, size int64, what string) error {
+	if left := reader.file.Size() - reader.offset; count < 0 || count > left/size {
+		return fmt.Errorf("too many %s for the name file: %d", what, count)
+	}
+	return nil
+}
+
+// Read the snapshots, the reference counts of shared blocks and the
+// versions of files which follow the file entries
+func (fSys *fileSystemImpl) loadExtras(reader *nameReader) error {
+	var numSnapshots, numRefs int64
+
+	if err := binary.Read(reader, binary.BigEndian, &numSnapshots); err != nil {
+		return err
+	} else if err = reader.fits(numSnapshots, _SnapshotSize, "snapshots"); err != nil {
+		return err
+	}
+
+	entry := make([]byte, _EntrySize)
+	for i := int64(0); i < numSnapshots; i++ {
+		var created, numFiles int64
+
+		name, err := readName(reader)
+		if err != nil {
+			return err
+		}
+		if err = binary.Read(reader, binary.BigEndian, &created); err != nil {
+			return err
+		}
+		if err = binary.Read(reader, binary.BigEndian, &numFiles); err != nil {
+			return err
+		} else if err = reader.fits(numFiles, _EntrySize, "snapshot files"); err != nil {
+			return err
+		}
+
+		snap := &snapshot{name: name, created: time.Unix(0, created), files: make(map[string]*fileInfo)}
+		for j := int64(0); j < numFiles; j++ {
+			if _, err = io.ReadFull(reader, entry); err != nil {
+				return err
+			}
+
+			info, err := parseFileInfo(entry)
+			if err != nil {
+				return err
+			}
+			snap.files[info.name] = info
+		}
+		fSys.snapshots[name] = snap
+	}
+
+	if err := binary.Read(reader, binary.BigEndian, &numRefs); err != nil {
+		return err
+	} else if err = reader.fits(numRefs, _RefSize, "reference counts"); err != nil {
+		return err
+	}
+
+	for i := int64(0); i < numRefs; i++ {
+		var index, count int64
+		if err := binary.Read(reader, binary.BigEndian, &index); err != nil {
+			return err
+		}
+		if err := binary.Read(reader, binary.BigEndian, &count); err != nil {
+			return err
+		}
+		fSys.refs[index] = count
+	}
+
+	// Versions were added in 0.3
+	if fSys.minor < 3 {
+		return nil
+	}
+	return fSys.loadVersions(reader)
+}
+
+// Read the versions of files which follow the reference counts
+func (fSys *fileSystemImpl) loadVersions(reader *nameReader) error {
+	var numFiles int64
+	if err := binary.Read(reader, binary.BigEndian, &numFiles); err != nil {
+		return err
+	} else if err = reader.fits(numFiles, _HistorySize, "versioned files"); err != nil {
+		return err
+	}
+
+	entry := make([]byte, _EntrySize)
+	for i := int64(0); i < numFiles; i++ {
+		var numVersions int64
+
+		name, err := readName(reader)
+		if err != nil {
+			return err
+		}
+
+		hist := &history{}
+		if err = binary.Read(reader, binary.BigEndian, &hist.latest); err != nil {
+			return err
+		}
+		if err = binary.Read(reader, binary.BigEndian, &numVersions); err != nil {
+			return err
+		} else if err = reader.fits(numVersions, _VersionSize, "versions"); err != nil {
+			return err
+		}
+
+		for j := int64(0); j < numVersions; j++ {
+			var number, recorded int64
+			if err = binary.Read(reader, binary.BigEndian, &number); err != nil {
+				return err
+			}
+			if err = binary.Read(reader, binary.BigEndian, &recorded); err != nil {
+				return err
+			}
+			if _, err = io.ReadFull(reader, entry); err != nil {
+				return err
+			}
+
+			info, err := parseFileInfo(entry)
+			if err != nil {
+				return err
+			}
+
+			hist.versions = append(hist.versions, &version{
+				number:   number,
+				recorded: time.Unix(0, recorded),
+				info:     info,
+			})
+		}
+		fSys.versions[name] = hist
+	}
+	return nil
+}
+
+// Checks that the name table only points at blocks within the data
+// file, so a damaged table is rejected rather than trusted.  The
+// chains of a clean table are walked as well.
+func (fSys *fileSystemImpl) checkNames(clean bool) error {
+	if fSys.sizeInBytes < 0 || fSys.sizeInBytes%_BlockSize != 0 || fSys.sizeInBytes > fSys.dataFile.Size() {
+		return fmt.Errorf("invalid data size: %d", fSys.sizeInBytes)
+	}
+
+	total := fSys.sizeInBytes / _BlockSize
+	inRange := func(index int64) bool {
+		return index >= _NullIndex && index < total
+	}
+
+	if !inRange(fSys.indexOfFirstFree) {
+		return fmt.Errorf("free list starts out of range: %d", fSys.indexOfFirstFree)
+	} else if fSys.numberFreeNodes < 0 || fSys.numberFreeNodes > total {
+		return fmt.Errorf("invalid number of free blocks: %d", fSys.numberFreeNodes)
+	}
+
+	for _, info := range fSys.entries() {
+		if info.size < 0 || info.size > total*_DataSize {
+			return fmt.Errorf("%s: invalid size: %d", info.name, info.size)
+		} else if !inRange(info.first) || !inRange(info.last) {
+			return fmt.Errorf("%s: blocks out of range: %d, %d", info.name, info.first, info.last)
+		}
+	}
+
+	for index, count := range fSys.refs {
+		if index < 0 || index >= total || count < 2 {
+			return fmt.Errorf("invalid reference count of block %d: %d", index, count)
+		}
+	}
+
+	if !clean {
+		return nil
+	}
+	return fSys.checkChains(total)
+}
+
+// Checks that every chain holds as many blocks as its size needs and
+// ends at its last block, that shared blocks are counted and that the
+// free list holds the rest.  Only a table written by a clean shutdown
+// is held to this, recover fixes the chains of any other.
+func (fSys *fileSystemImpl) checkChains(total int64) error {
+	used := make(map[int64]bool)
+	incoming := make(map[int64]int64)
+
+	for _, info := range fSys.entries() {
+		want := blocksFor(info.size)
+		last := int64(_NullIndex)
+		seen := make(map[int64]bool)
+
+		curr := info.first
+		for count := int64(0); curr != _NullIndex; count++ {
+			if seen[curr] {
+				return fmt.Errorf("%s: block chain loops at %d", info.name, curr)
+			} else if count == want {
+				return fmt.Errorf("%s: block chain is longer than %d blocks", info.name, want)
+			}
+
+			node, err := fSys.getBlock(curr)
+			if err != nil {
+				return err
+			}
+
+			// The links of a shared block are only counted once
+			if !used[curr] && node.next != _NullIndex {
+				incoming[node.next]++
+			}
+			seen[curr], used[curr] = true, true
+			last, curr = curr, node.next
+		}
+
+		if int64(len(seen)) != want {
+			return fmt.Errorf("%s: block chain has %d blocks, want %d", info.name, len(seen), want)
+		} else if last != info.last {
+			return fmt.Errorf("%s: block chain ends at %d, not %d", info.name, last, info.last)
+		}
+		if info.first != _NullIndex {
+			incoming[info.first]++
+		}
+	}
+
+	for index, count := range incoming {
+		if count > 1 && fSys.refs[index] != count {
+			return fmt.Errorf("block %d is shared %d times, counted %d", index, count, fSys.refs[index])
+		}
+	}
+	for index := range fSys.refs {
+		if incoming[index] < 2 {
+			return fmt.Errorf("block %d is not shared", index)
+		}
+	}
+
+	var count int64
+	for curr := fSys.indexOfFirstFree; curr != _NullIndex; count++ {
+		if count == fSys.numberFreeNodes {
+			return fmt.Errorf("free list is longer than %d blocks", fSys.numberFreeNodes)
+		} else if used[curr] {
+			return fmt.Errorf("free block %d is in use", curr)
+		}
+
+		node, err := fSys.getBlock(curr)
+		if err != nil {
+			return err
+		}
+		used[curr] = true
+		curr = node.next
+	}
+	if count != fSys.numberFreeNodes {
+		return fmt.Errorf("free list has %d blocks, want %d", count, fSys.numberFreeNodes)
 	}
 	return nil
 }
 
+// Converts the snapshots, the reference counts of shared blocks and
+// the versions of files to bytes
+func (fSys *fileSystemImpl) encodeExtras() []byte {
+	var buffer bytes.Buffer
+
+	binary.Write(&buffer, binary.BigEndian, int64(len(fSys.snapshots)))
+	for _, snap := range fSys.sortedSnapshots() {
+		buffer.Write(encodeName(snap.name))
+		binary.Write(&buffer, binary.BigEndian, snap.created.UnixNano())
+		binary.Write(&buffer, binary.BigEndian, int64(len(snap.files)))
+		for _, name := range sortedNames(snap.files) {
+			buffer.Write(encodeFileInfo(snap.files[name]))
+		}
+	}
+
+	indices := make([]int64, 0, len(fSys.refs))
+	for index := range fSys.refs {
+		indices = append(indices, index)
+	}
+	sort.Slice(indices, func(i, j int) bool { return indices[i] < indices[j] })
+
+	binary.Write(&buffer, binary.BigEndian, int64(len(indices)))
+	for _, index := range indices {
+		binary.Write(&buffer, binary.BigEndian, index)
+		binary.Write(&buffer, binary.BigEndian, fSys.refs[index])
+	}
+
+	binary.Write(&buffer, binary.BigEndian, int64(len(fSys.versions)))
+	for _, name := range sortedVersionNames(fSys.versions) {
+		hist := fSys.versions[name]
+
+		buffer.Write(encodeName(name))
+		binary.Write(&buffer, binary.BigEndian, hist.latest)
+		binary.Write(&buffer, binary.BigEndian, int64(len(hist.versions)))
+		for _, v := range hist.versions {
+			binary.Write(&buffer, binary.BigEndian, v.number)
+			binary.Write(&buffer, binary.BigEndian, v.recorded.UnixNano())
+			buffer.Write(encodeFileInfo(v.info))
+		}
+	}
+
+	return buffer.Bytes()
+}
+
+// Encodes the header, every file entry, the snapshots, the reference
+// counts and the versions as they are stored in the name file
+func (fSys *fileSystemImpl) encodeNames() []byte {
+	names := sortedNames(fSys.files)
+
+	fSys.numFiles = int64(len(names))
+
+	buffer := bytes.NewBuffer(fSys.encodeHeader())
+	for _, name := range names {
+		buffer.Write(encodeFileInfo(fSys.files[name]))
+	}
+	buffer.Write(fSys.encodeExtras())
+
+	return buffer.Bytes()
+}
+
+// Write the name table to the name file
+func (fSys *fileSystemImpl) writeNames() error {
+	if err := fSys.commitNames(fSys.encodeNames()); err != nil {
+		return err
+	}
+	return fSys.releaseFreed()
+}
+
 // Initializes the filesystem after the MMAPFile has been
 // opened
 func (fSys *fileSystemImpl) init() error {
+	prefixName := path.Join(fSys.fsDirectory, fSys.fsName)
+
 	var err error
-	var file gofs.File
+	fSys.nameFile, err = fSys.open(prefixName+"-name", fSys.readOnly)
+	if err != nil {
+		return err
+	}
 
-	prefixName := path.Join(fSys.fsDirectory, fSys.fsName)
+	fSys.dataFile, err = fSys.open(prefixName+"-data", fSys.readOnly)
+	if err != nil {
+		fSys.nameFile.Close()
+		return err
+	}
 
-	file, err = mmap.NewFile(prefixName + "-name")
-	goassert.ErrorAssert(err, "Could not open name file")
-	fSys.nameFile = file.(mmap.File)
+	// Containers written before the journal have none to open
+	// read-only
+	fSys.journal, err = fSys.open(prefixName+"-journal", fSys.readOnly)
+	if err != nil && fSys.readOnly {
+		fSys.journal, err = nil, nil
+	}
 
-	file, err = mmap.NewFile(prefixName + "-data")
-	goassert.ErrorAssert(err, "Could not open data file")
-	fSys.dataFile = file.(mmap.File)
+	if err == nil {
+		err = fSys.load()
+	}
 
-	goassert.ErrorAssert(fSys.readHeader(), "Could not read header")
-	goassert.ErrorAssert(fSys.loadFiles(), "Could not load files")
+	if err != nil {
+		fSys.nameFile.Close()
+		fSys.dataFile.Close()
+		if fSys.journal != nil {
+			fSys.journal.Close()
+		}
+	}
 
 	return err
 }
 
-func (fSys *fileSystemImpl) pushFreeNode(node fileNode) {
-	if node.id != _NullIndex {
-		node.next = fSys.indexOfFirstFree
-		if node.next != _NullIndex {
-			free := fSys.getBlock(node.next)
-			free.prev = node.id
+// Loads the name table, finishing the last write of it and
+// recovering the free list if the filesystem was not shut down
+// cleanly
+func (fSys *fileSystemImpl) load() error {
+	state, names, err := fSys.readJournal()
+	if err != nil {
+		return err
+	}
+
+	if names != nil && fSys.readOnly {
+		// Read the table from the journal instead of finishing it
+		pending := device.NewMemory()
+		if err = writeAt(pending, names, 0); err != nil {
+			return err
+		}
+		fSys.nameFile.Close()
+		fSys.nameFile = pending
+	} else if names != nil {
+		if err = writeAt(fSys.nameFile, names, 0); err != nil {
+			return err
+		} else if err = fSys.nameFile.Sync(); err != nil {
+			return err
+		}
+	}
+
+	if fSys.nameFile.Size() == 0 {
+		fSys.indexOfFirstFree = _NullIndex
+		fSys.indexOfLastFree = _NullIndex
+		if fSys.readOnly {
+			return gofs.ErrReadOnly
+		}
+		err = fSys.writeNames()
+	} else if err = fSys.readHeader(); err == nil {
+		if err = fSys.loadFiles(); err == nil {
+			err = fSys.checkNames(state == _JournalClean)
 		}
-		fSys.indexOfFirstFree = node.id
 	}
+
+	if err != nil || fSys.readOnly {
+		return err
+	} else if state != _JournalClean {
+		if err = fSys.recover(); err != nil {
+			return err
+		}
+	}
+	return fSys.markJournal(_JournalDirty)
 }
 
-func (fSys *fileSystemImpl) popFreeNode() fileNode {
-	result := fileNode{
-		data: nil,
-		prev: _NullIndex,
-		next: _NullIndex,
-		id:   _NullIndex,
+// Detaches the first node of the free list and clears it.  The
+// data file is grown if the free list is empty.
+func (fSys *fileSystemImpl) popFreeNode() (fileNode, error) {
+	if fSys.indexOfFirstFree == _NullIndex {
+		if err := fSys.growBy(_GrowFactor * _BlockSize); err != nil {
+			return fileNode{}, err
+		}
+	}
+
+	result, err := fSys.getBlock(fSys.indexOfFirstFree)
+	if err != nil {
+		return result, err
 	}
+
+	fSys.indexOfFirstFree = result.next
+	fSys.numberFreeNodes--
 	if fSys.indexOfFirstFree != _NullIndex {
-		result = fSys.getBlock(fSys.indexOfFirstFree)
-		fSys.indexOfFirstFree = result.next
-		if fSys.indexOfFirstFree != _NullIndex {
-			freeListHead := fSys.getBlock(result.next)
-			freeListHead.prev = _NullIndex
+		freeListHead, err := fSys.getBlock(result.next)
+		if err != nil {
+			return result, err
+		}
+		freeListHead.prev = _NullIndex
+		if err = fSys.writeNode(freeListHead); err != nil {
+			return result, err
 		}
-		result.next = _NullIndex
 	}
-	return result
+
+	result.prev = _NullIndex
+	result.next = _NullIndex
+	result.data = make([]byte, _DataSize)
+
+	return result, fSys.writeNode(result)
 }
 
-func (fSys *fileSystemImpl) allocateBlocksFromFreeList(numBlocks int64) (head, tail fileNode) {
-	head = fileNode{}
-	tail = fileNode{}
+// Places the node at the beginning of the free list
+func (fSys *fileSystemImpl) pushFreeNode(node fileNode) error {
+	node.prev = _NullIndex
+	node.next = fSys.indexOfFirstFree
+	if node.next != _NullIndex {
+		free, err := fSys.getBlock(node.next)
+		if err != nil {
+			return err
+		}
+		free.prev = node.id
+		if err = fSys.writeNode(free); err != nil {
+			return err
+		}
+	}
+
+	fSys.indexOfFirstFree = node.id
+	fSys.numberFreeNodes++
 
-	return
+	return fSys.writeNode(node)
 }
 
-func (fSys *fileSystemImpl) allocateNewBlocks(numBlocks int64) (head, tail fileNode) {
-	head = fileNode{}
-	tail = fileNode{}
-	return
+// Releases a reference to the chain of blocks starting at first.
+// Blocks are freed until one is reached which is still shared, the
+// rest of the chain is still in use by others.  They only go on the
+// free list once the name table has been written without them, as
+// until then a crash can bring back the table that uses them.
+func (fSys *fileSystemImpl) freeBlocks(first int64) error {
+	seen := make(map[int64]bool)
+	for curr := first; curr != _NullIndex; {
+		if seen[curr] {
+			return fmt.Errorf("block chain from %d loops at %d", first, curr)
+		} else if fSys.decRef(curr) > 0 {
+			return nil
+		}
+		seen[curr] = true
+
+		node, err := fSys.getBlock(curr)
+		if err != nil {
+			return err
+		}
+
+		fSys.freed = append(fSys.freed, curr)
+		curr = node.next
+	}
+	return nil
 }
 
-func (fSys *fileSystemImpl) concatNodes(first, second int64) {
-	before := fSys.getBlock(first)
-	after := fSys.getBlock(second)
-	before.next = after.id
-	after.prev = before.id
+// Places the blocks freed since the name table was last written on
+// the free list
+func (fSys *fileSystemImpl) releaseFreed() error {
+	for len(fSys.freed) > 0 {
+		node, err := fSys.getBlock(fSys.freed[0])
+		if err != nil {
+			return err
+		} else if err = fSys.pushFreeNode(node); err != nil {
+			return err
+		}
+		fSys.freed = fSys.freed[1:]
+	}
+	fSys.freed = nil
+	return nil
+}
+
+// The number of chains which reference the block.  Only counts of
+// blocks shared by more than one chain are stored.
+func (fSys *fileSystemImpl) refCount(index int64) int64 {
+	if count, exists := fSys.refs[index]; exists {
+		return count
+	}
+	return 1
 }
 
-func (fSys *fileSystemImpl) allocateBlocks(numBlocks int64) (head, tail fileNode) {
+func (fSys *fileSystemImpl) incRef(index int64) {
+	if index != _NullIndex {
+		fSys.refs[index] = fSys.refCount(index) + 1
+	}
+}
 
-	if fSys.numberFreeNodes > 0 {
-		fromFree := int64(gomath.MinInt(int(numBlocks), int(fSys.numberFreeNodes)))
-		head, tail = fSys.allocateBlocksFromFreeList(fromFree)
-		numBlocks -= fromFree
+// Drops a reference to the block and returns how many are left
+func (fSys *fileSystemImpl) decRef(index int64) int64 {
+	count := fSys.refCount(index) - 1
+	if count > 1 {
+		fSys.refs[index] = count
+	} else {
+		delete(fSys.refs, index)
 	}
+	return count
+}
 
-	if numBlocks > 0 {
-		middle, end := fSys.allocateNewBlocks(numBlocks)
-		tail.next = middle.id
-		middle.prev = tail.id
-		tail = end
+// Copies a shared block into a new block which is only referenced by
+// the caller.  The copy points at the same next block as the original.
+func (fSys *fileSystemImpl) copyBlock(node fileNode) (fileNode, error) {
+	result, err := fSys.popFreeNode()
+	if err != nil {
+		return result, err
 	}
 
-	return
+	copy(result.data, node.data)
+	result.next = node.next
+
+	fSys.incRef(node.next)
+	fSys.decRef(node.id)
+
+	return result, fSys.writeNode(result)
 }
 
-func (fSys *fileSystemImpl) growBy(bytes int64) {
-	beginSize := fSys.dataFile.Size()
-	finalSize := fSys.dataFile.Size() + bytes
+func (fSys *fileSystemImpl) concatNodes(first, second int64) error {
+	before, err := fSys.getBlock(first)
+	if err != nil {
+		return err
+	}
 
-	fSys.indexOfFirstFree = fSys.dataFile.Size()
-	fSys.dataFile.Seek(_BlockSize*1024, os.SEEK_END)
-	fSys.dataFile.Write([]byte{0})
+	after, err := fSys.getBlock(second)
+	if err != nil {
+		return err
+	}
 
-	underlying := fSys.dataFile.Bytes()[beginSize:]
-	for i := beginSize; i < finalSize; i += _BlockSize {
-		curr := rawRead(underlying)
+	before.next = after.id
+	after.prev = before.id
 
-		underlying = underlying[_BlockSize:]
+	if err = fSys.writeNode(before); err != nil {
+		return err
 	}
+	return fSys.writeNode(after)
 }
 
-func rawRead(underlying []byte) fileNode {
-	result := fileNode{}
-	result.next, _ = binary.Varint(underlying[0:_PointerSize])
-	result.prev, _ = binary.Varint(underlying[_PointerSize:_PointerSize])
-	result.data = underlying[2*_PointerSize : _DataSize]
-	return result
+// Takes numBlocks from the free list, growing the data file if
+// needed, and chains them after the block given.  Returns the
+// first and last of the new blocks.
+func (fSys *fileSystemImpl) allocateBlocks(numBlocks, after int64) (head, tail int64, err error) {
+	if fSys.numberFreeNodes < numBlocks {
+		needed := gomath.MaxInt64(numBlocks-fSys.numberFreeNodes, _GrowFactor)
+		if err = fSys.growBy(needed * _BlockSize); err != nil {
+			return
+		}
+	}
+
+	head, tail = _NullIndex, after
+	for i := int64(0); i < numBlocks; i++ {
+		var node fileNode
+		if node, err = fSys.popFreeNode(); err != nil {
+			return
+		}
+
+		if tail != _NullIndex {
+			if err = fSys.concatNodes(tail, node.id); err != nil {
+				return
+			}
+		}
+
+		if head == _NullIndex {
+			head = node.id
+		}
+		tail = node.id
+	}
+
+	return
 }
 
-// node.data is a slice of the underlying mmap file so it is
-// managed by the OS
-func (fSys *fileSystemImpl) writeNode(node fileNode) {
-	underlying := fSys.dataFile.Bytes()[_BlockSize*node.id : _EntrySize]
-	binary.PutVarint(underlying[0:_PointerSize], node.prev)
-	binary.PutVarint(underlying[_PointerSize:_PointerSize], node.next)
+// Grows the data file by the given number of bytes, rounded up
+// to whole blocks, and places the new blocks on the free list
+func (fSys *fileSystemImpl) growBy(bytes int64) error {
+	numBlocks := (bytes + _BlockSize - 1) / _BlockSize
+	firstNew := fSys.sizeInBytes / _BlockSize
+	lastNew := firstNew + numBlocks - 1
+
+	underlying := make([]byte, numBlocks*_BlockSize)
+	for i := firstNew; i <= lastNew; i++ {
+		node := fileNode{id: i, prev: i - 1, next: i + 1}
+		if i == firstNew {
+			node.prev = _NullIndex
+		}
+		if i == lastNew {
+			node.next = fSys.indexOfFirstFree
+		}
+		rawWrite(underlying[(i-firstNew)*_BlockSize:], node)
+	}
+
+	if err := fSys.dataFile.Grow(fSys.sizeInBytes + numBlocks*_BlockSize); err != nil {
+		return err
+	} else if err := writeAt(fSys.dataFile, underlying, fSys.sizeInBytes); err != nil {
+		return err
+	}
+
+	if fSys.indexOfFirstFree != _NullIndex {
+		head, err := fSys.getBlock(fSys.indexOfFirstFree)
+		if err != nil {
+			return err
+		}
+		head.prev = lastNew
+		if err = fSys.writeNode(head); err != nil {
+			return err
+		}
+	}
+
+	fSys.indexOfFirstFree = firstNew
+	fSys.numberFreeNodes += numBlocks
+	fSys.sizeInBytes += numBlocks * _BlockSize
+
+	return nil
 }
 
-// Retrieves a block from the data file given an index
-// If the index is NULL
-func (fSys *fileSystemImpl) getBlock(index int64) fileNode {
+func rawRead(underlying []byte) (fileNode, error) {
+	if len(underlying) < _BlockSize {
+		return fileNode{}, fmt.Errorf("incorrect block size: %d", len(underlying))
+	}
+
 	result := fileNode{}
-	var underlying []byte
+	result.prev = int64(binary.BigEndian.Uint64(underlying[0:_PointerSize]))
+	result.next = int64(binary.BigEndian.Uint64(underlying[_PointerSize : 2*_PointerSize]))
+	result.data = underlying[2*_PointerSize : _BlockSize]
+	return result, nil
+}
 
-	if index == _NullIndex {
+func rawWrite(underlying []byte, node fileNode) {
+	binary.BigEndian.PutUint64(underlying[0:_PointerSize], uint64(node.prev))
+	binary.BigEndian.PutUint64(underlying[_PointerSize:2*_PointerSize], uint64(node.next))
+	copy(underlying[2*_PointerSize:_BlockSize], node.data)
+}
 
-		if fSys.indexOfFirstFree == _NullIndex {
-			fSys.growBy(_GrowFactor * _BlockSize)
-		}
+// Writes the node back to the data file
+func (fSys *fileSystemImpl) writeNode(node fileNode) error {
+	underlying := make([]byte, _BlockSize)
+	rawWrite(underlying, node)
+	return writeAt(fSys.dataFile, underlying, _BlockSize*node.id)
+}
+
+// Retrieves a block from the data file given an index.  The data
+// of the block is a copy so writeNode must be called to save any
+// changes.
+func (fSys *fileSystemImpl) getBlock(index int64) (fileNode, error) {
+	// A snapshot view reads the blocks of the file system it was
+	// opened from, which may have grown or been compacted since
+	size := fSys.sizeInBytes
+	if fSys.parent != nil {
+		size = fSys.parent.sizeInBytes
+	}
 
-		// TODO: possible to move to a function?  Can't use popFreeNode because
-		// it calls getBlock, possible to change popFreeNode to be more lower
-		// level?
-		underlying = fSys.dataFile.Bytes()[_BlockSize*fSys.indexOfFirstFree : _EntrySize]
-		binary.PutVarint(underlying[0:_PointerSize], _NullIndex)
-		binary.PutVarint(underlying[_PointerSize:_PointerSize], _NullIndex)
-		fSys.indexOfFirstFree = result.next
+	if index < 0 || index >= size/_BlockSize {
+		return fileNode{}, fmt.Errorf("block index out of range: %d", index)
+	}
 
-		// TODO: Write memset?
-		for i := 0; i < len(result.data); i++ {
-			result.data[i] = 0
-		}
+	underlying := make([]byte, _BlockSize)
+	if err := readAt(fSys.dataFile, underlying, _BlockSize*index); err != nil {
+		return fileNode{}, err
 	}
 
-	underlying = fSys.dataFile.Bytes()[_BlockSize*index : _EntrySize]
-	result = rawRead(underlying)
+	result, err := rawRead(underlying)
 	result.id = index
 
-	return result
+	return result, err
 }
@@ -8,10 +8,15 @@
 package concrete
 
 import (
+	"context"
+	"fmt"
 	"io"
+	"sync"
+	"time"
 
 	"github.com/deathly809/gofs"
-	"github.com/deathly809/gofs/mmap"
+	"github.com/deathly809/gofs/device"
+	"github.com/deathly809/gofs/internal/fsutil"
 )
 
 // Each file in the FileSystem is represented by a linked
@@ -28,7 +33,7 @@ const (
 	// Major version of the filesystem
 	Major = int32(0)
 	// Minor version of the filesystem
-	Minor = int32(1)
+	Minor = int32(3)
 	// Patch version of the filesystem
 	Patch = int32(0)
 )
@@ -75,40 +80,220 @@ const (
 	_DataSize    = _BlockSize - 2*_PointerSize
 )
 
+// FileSystem is a gofs.FileSystem stored in a name file and a
+// data file which also supports clones, snapshots and versions
+type FileSystem interface {
+	gofs.FileSystem
+
+	//	Clone creates the file dst with the contents of src.  No
+	//	data is copied, the files share blocks until either one
+	//	writes to them.
+	//
+	//	An error is returned if src does not exist or dst does.
+	Clone(src, dst string) error
+
+	//	Snapshot records a read-only, point-in-time copy of every
+	//	file under the given name.  No data is copied, blocks are
+	//	shared until either side changes them.
+	Snapshot(string) error
+
+	//	Snapshots lists the snapshots from oldest to newest
+	Snapshots() []SnapshotInfo
+
+	//	OpenSnapshot returns a read-only FileSystem containing the
+	//	files as they were when the snapshot was taken.  It stays
+	//	usable until it, or the FileSystem, is shut down.
+	OpenSnapshot(string) (gofs.FileSystem, error)
+
+	//	DeleteSnapshot removes the snapshot and releases any blocks
+	//	no longer used.  Open snapshots cannot be deleted.
+	DeleteSnapshot(string) error
+
+	//	Versions lists the recorded versions of a file from oldest
+	//	to newest.  Versions are only recorded when the FileSystem
+	//	is opened with the Versioned option.
+	Versions(string) []VersionInfo
+
+	//	OpenVersion returns a read-only handle to a version of a file
+	OpenVersion(string, int64) (gofs.File, error)
+
+	//	RestoreVersion replaces the contents of a file with those of
+	//	one of its versions
+	RestoreVersion(string, int64) error
+
+	//	PruneVersions removes all but the newest versions of a file
+	PruneVersions(filename string, keep int) error
+
+	//	PruneVersionsBefore removes the versions of a file recorded
+	//	before the given time
+	PruneVersionsBefore(string, time.Time) error
+
+	//	Begin starts a transaction.  Changes made through the
+	//	transaction are only seen by others once it is committed.
+	Begin() (Tx, error)
+
+	//	Compact makes the blocks of each file contiguous, moves the
+	//	free blocks to the end of the data file and then shrinks the
+	//	name and data files.  The blocks in use are copied past the
+	//	end of the data file first, so it needs room for them twice.
+	Compact(progress func(CompactProgress)) error
+}
+
 // The actual implementation
 type fileSystemImpl struct {
-	numFiles         int64                // number of files in the filesystem
-	sizeInBytes      int64                // the total number of bytes that the files take up
-	indexOfFirstFree int64                // the index of the first free node
-	indexOfLastFree  int64                // the index of the last free node
-	numberFreeNodes  int64                // The number of nodes on the free list
-	safeFiles        map[string]gofs.File // the list of files which are locked
-	files            map[string]fileInfo  // the list of files in the file system
-	dataFile         mmap.File            // the data file
-	nameFile         mmap.File            // the name file
-	fsName           string               // name of the file system
-	fsDirectory      string               // directory where stored on disk
-	rawData          []byte               // underlying data
+	numFiles         int64                      // number of files in the filesystem
+	sizeInBytes      int64                      // the number of bytes of the data file used by blocks
+	indexOfFirstFree int64                      // the index of the first free node
+	indexOfLastFree  int64                      // the index of the last free node
+	numberFreeNodes  int64                      // The number of nodes on the free list
+	files            map[string]*fileInfo       // the list of files in the file system
+	openFiles        map[*fileInfo][]*file      // the open handles of each file
+	refs             map[int64]int64            // reference counts of blocks shared by more than one chain
+	freed            []int64                    // blocks released since the name table was last written
+	snapshots        map[string]*snapshot       // the snapshots of the file system
+	versions         map[string]*history        // the recorded versions of each file
+	versioned        bool                       // record a version when a modified file is closed
+	transactions     map[*transaction]bool      // the transactions which have not finished
+	views            map[*fileSystemImpl]string // the open snapshots and their names
+	parent           *fileSystemImpl            // the file system an open snapshot belongs to
+	minor            int32                      // minor version the name file was written with
+	dataFile         device.BlockDevice         // the data file
+	nameFile         device.BlockDevice         // the name file
+	journal          device.BlockDevice         // makes writing the name file atomic
+	fsName           string                     // name of the file system
+	fsDirectory      string                     // directory where stored on disk
+	readOnly         bool                       // opened without write access
+	open             device.Opener              // opens the name and data files
+	state            *fsutil.State              // locks, I/O in progress and safe readers and writers
+	lock             *sync.Mutex                // guards the metadata and the backing files
+}
+
+// Option changes how Open loads a filesystem
+type Option func(*fileSystemImpl)
+
+// ReadOnly opens an existing filesystem without write access.
+// Both backing files are mapped read-only, any attempt to modify
+// the filesystem returns gofs.ErrReadOnly and nothing is written
+// back to disk.
+func ReadOnly() Option {
+	return func(fSys *fileSystemImpl) {
+		fSys.readOnly = true
+	}
+}
+
+// InMemory keeps both backing files in memory instead of on disk.
+// The directory and name are ignored and everything is lost when the
+// filesystem is shut down.
+func InMemory() Option {
+	return Storage(device.OpenMemory)
+}
+
+// Storage opens the name and data files with the given opener.  The
+// default memory maps them with device.OpenMmap.
+func Storage(open device.Opener) Option {
+	return func(fSys *fileSystemImpl) {
+		fSys.open = open
+	}
 }
 
 func (fSys *fileSystemImpl) GetSafeWriter(file gofs.File) io.Writer {
-	return nil
+	return fSys.state.SafeWriter(file)
 }
 
 func (fSys *fileSystemImpl) GetSafeReader(file gofs.File) io.Reader {
-	return nil
+	return fSys.state.SafeReader(file)
 }
 
-func (fSys *fileSystemImpl) Shutdown() {
+func (fSys *fileSystemImpl) Shutdown(ctx context.Context) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
 
+	return fSys.state.Shutdown(ctx, func() error {
+		if fSys.parent != nil {
+			delete(fSys.parent.views, fSys)
+			return nil
+		}
+		return fSys.closeFiles()
+	})
+}
+
+// Rolls back unfinished transactions, releases the deleted files
+// which are still open, closes the open snapshots, saves the name
+// table and closes the backing files
+func (fSys *fileSystemImpl) closeFiles() error {
+	var err error
+
+	for t := range fSys.transactions {
+		if e := t.rollback(); err == nil {
+			err = e
+		}
+	}
+
+	for info := range fSys.openFiles {
+		if info.deleted {
+			if e := fSys.freeBlocks(info.first); err == nil {
+				err = e
+			}
+		}
+	}
+
+	for view := range fSys.views {
+		view.state.Close()
+	}
+
+	if !fSys.readOnly {
+		// Blocks freed since the name table was last written only
+		// reach the free list after it is written, so it is written
+		// again to record them
+		freed := len(fSys.freed) > 0
+		if e := fSys.writeNames(); err == nil {
+			err = e
+		}
+		if freed && err == nil {
+			err = fSys.writeNames()
+		}
+
+		// Only a clean shutdown lets the free list be trusted
+		if err == nil {
+			err = fSys.markJournal(_JournalClean)
+		}
+	}
+
+	if e := fSys.nameFile.Close(); err == nil {
+		err = e
+	}
+	if e := fSys.dataFile.Close(); err == nil {
+		err = e
+	}
+	if fSys.journal != nil {
+		if e := fSys.journal.Close(); err == nil {
+			err = e
+		}
+	}
+
+	return err
 }
 
 func (fSys *fileSystemImpl) Lock(file gofs.File) {
+	if file == nil {
+		return
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
 
+	fSys.state.Lock(file)
 }
 
 func (fSys *fileSystemImpl) Unlock(file gofs.File) {
+	if file == nil {
+		return
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
 
+	fSys.state.Unlock(file)
 }
 
 func (fSys *fileSystemImpl) GetWriter() io.Writer {
@@ -116,27 +301,247 @@ func (fSys *fileSystemImpl) GetWriter() io.Writer {
 }
 
 func (fSys *fileSystemImpl) Open(filename string) gofs.File {
+	if len(filename) == 0 || len(filename) > _NameSize {
+		return nil
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status != fsutil.Open {
+		return nil
+	}
+
+	info, exists := fSys.files[filename]
+	if !exists {
+		if fSys.readOnly {
+			return nil
+		}
+
+		now := time.Now()
+		info = &fileInfo{
+			name:         filename,
+			first:        _NullIndex,
+			last:         _NullIndex,
+			created:      now,
+			lastModified: now,
+		}
+
+		fSys.files[filename] = info
+		if err := fSys.writeNames(); err != nil {
+			delete(fSys.files, filename)
+			return nil
+		}
+	}
+
+	handle := &file{
+		fs:     fSys,
+		curr:   fileNode{id: _NullIndex},
+		fInfo:  info,
+		isnew:  !exists,
+		status: fsutil.Open,
+	}
+	fSys.openFiles[info] = append(fSys.openFiles[info], handle)
+
+	return handle
+}
+
+// Forgets the block each handle of the file was at, used when the
+// chain of blocks changes
+func (fSys *fileSystemImpl) invalidate(info *fileInfo) {
+	for _, handle := range fSys.openFiles[info] {
+		handle.curr = fileNode{id: _NullIndex}
+	}
+}
+
+// Moves the open handles of one file to another
+func (fSys *fileSystemImpl) moveHandles(from, to *fileInfo) {
+	for _, handle := range fSys.openFiles[from] {
+		handle.fInfo = to
+		handle.curr = fileNode{id: _NullIndex}
+		fSys.openFiles[to] = append(fSys.openFiles[to], handle)
+	}
+	delete(fSys.openFiles, from)
+}
+
+// Releases the blocks of a file which is no longer in the name
+// table, or marks them to be released once its last handle is closed
+func (fSys *fileSystemImpl) release(info *fileInfo) error {
+	if len(fSys.openFiles[info]) > 0 {
+		info.deleted = true
+		return nil
+	}
+	return fSys.freeBlocks(info.first)
+}
+
+// Removes the handle from the open file table.  If it was the last
+// handle of a deleted file the blocks of the file are freed.
+func (fSys *fileSystemImpl) closeHandle(handle *file) error {
+	handles := fSys.openFiles[handle.fInfo]
+	for i, h := range handles {
+		if h == handle {
+			handles = append(handles[:i], handles[i+1:]...)
+			break
+		}
+	}
+
+	if len(handles) > 0 {
+		fSys.openFiles[handle.fInfo] = handles
+		return nil
+	}
+	delete(fSys.openFiles, handle.fInfo)
+
+	// Safe readers and writers of the name have no handle left to use
+	if !fSys.inUse(handle.fInfo.name) {
+		fSys.state.ReleaseGuard(handle.fInfo.name)
+	}
+
+	if handle.fInfo.deleted {
+		return fSys.freeBlocks(handle.fInfo.first)
+	}
 	return nil
 }
 
-func (fSys *fileSystemImpl) Exists(filename string) bool {
+// Returns whether a handle is open on a file with the name, even one
+// which has since been deleted
+func (fSys *fileSystemImpl) inUse(filename string) bool {
+	for info := range fSys.openFiles {
+		if info.name == filename {
+			return true
+		}
+	}
 	return false
 }
 
-func (fSys *fileSystemImpl) Delete(filename string) {
+func (fSys *fileSystemImpl) Exists(filename string) bool {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	_, exists := fSys.files[filename]
+	return exists && fSys.state.Status != fsutil.Closed
+}
+
+func (fSys *fileSystemImpl) Delete(filename string) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	} else if fSys.readOnly {
+		return gofs.ErrReadOnly
+	}
+
 	info, exists := fSys.files[filename]
 	// Remove from list of files,
 	if exists {
-		//fSys.Lock(filename)
 		delete(fSys.files, filename)
-		//fSys.Unlock(filename)
 
-		// add the file to the free list
-		// fSys.Lock("freelist")
-		block := fSys.getBlock(info.last)
-		block.next = fSys.indexOfFirstFree
-		fSys.indexOfFirstFree = info.first
-		// fSys.UnLock("freelist")
+		// add the file to the free list once the last
+		// handle is closed
+		if err := fSys.release(info); err != nil {
+			return err
+		}
+
+		if err := fSys.releaseVersions(filename); err != nil {
+			return err
+		}
+
+		return fSys.writeNames()
+	}
+	return nil
+}
+
+func (fSys *fileSystemImpl) Stat(filename string) gofs.FileStats {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	info, exists := fSys.files[filename]
+	if !exists || fSys.state.Status == fsutil.Closed {
+		return nil
+	}
+
+	handles := make([]gofs.File, 0, len(fSys.openFiles[info]))
+	for _, handle := range fSys.openFiles[info] {
+		handles = append(handles, handle)
+	}
+
+	return fsutil.NewFileStats(info.created, info.lastModified, info.size, handles)
+}
+
+func (fSys *fileSystemImpl) Names() []string {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return nil
+	}
+	return sortedNames(fSys.files)
+}
+
+func (fSys *fileSystemImpl) SetLastModified(filename string, t time.Time) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	}
+
+	info, exists := fSys.files[filename]
+	if !exists {
+		return fmt.Errorf("file does not exist: %s", filename)
+	}
+	info.lastModified = t
+	return fSys.writeNames()
+}
+
+// Rename moves the file in a transaction of its own
+func (fSys *fileSystemImpl) Rename(oldName, newName string) error {
+	tx, err := fSys.Begin()
+	if err != nil {
+		return err
+	}
+
+	if err = tx.Rename(oldName, newName); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (fSys *fileSystemImpl) Clone(src, dst string) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
 
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	} else if len(dst) == 0 || len(dst) > _NameSize {
+		return fmt.Errorf("invalid file name: %q", dst)
+	} else if _, exists := fSys.files[dst]; exists {
+		return fmt.Errorf("file already exists: %s", dst)
 	}
+
+	info, exists := fSys.files[src]
+	if !exists {
+		return fmt.Errorf("file does not exist: %s", src)
+	}
+
+	now := time.Now()
+	clone := info.clone()
+	clone.name = dst
+	clone.created = now
+	clone.lastModified = now
+
+	// Both files now reference the chain through their first block.
+	// The source only stops owning its blocks once the clone is
+	// recorded.
+	fSys.incRef(info.first)
+	fSys.files[dst] = clone
+	if err := fSys.writeNames(); err != nil {
+		delete(fSys.files, dst)
+		fSys.decRef(info.first)
+		return err
+	}
+
+	info.owned = 0
+	return nil
 }
@@ -0,0 +1,73 @@
+package concrete
+
+import (
+	"io"
+	"testing"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/device"
+	"github.com/deathly809/gofs/fstest"
+)
+
+// Returns a constructor of empty file systems opened with the options
+func newFS(t *testing.T, opts ...Option) func() gofs.FileSystem {
+	return func() gofs.FileSystem {
+		fs, err := Open(t.TempDir(), "test", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+}
+
+func TestConformance(t *testing.T) {
+	t.Run("Mmap", func(t *testing.T) {
+		fstest.TestFileSystem(t, newFS(t))
+	})
+	t.Run("File", func(t *testing.T) {
+		fstest.TestFileSystem(t, newFS(t, Storage(device.OpenFile)))
+	})
+	t.Run("Memory", func(t *testing.T) {
+		fstest.TestFileSystem(t, newFS(t, InMemory()))
+	})
+}
+
+// Replaces the contents of the file
+func writeFile(t *testing.T, fs gofs.FileSystem, name, contents string) {
+	t.Helper()
+
+	fs.Delete(name)
+	file := fs.Open(name)
+	if file == nil {
+		t.Fatalf("could not open %s", name)
+	} else if _, err := file.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	} else if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Reads the whole file through the handle
+func readAll(t *testing.T, file gofs.File) string {
+	t.Helper()
+
+	file.Seek(0, int(gofs.Beginning))
+	data, err := io.ReadAll(io.LimitReader(file, file.Size()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Reads the whole file, which must exist
+func readFile(t *testing.T, fs gofs.FileSystem, name string) string {
+	t.Helper()
+
+	if !fs.Exists(name) {
+		t.Fatalf("%s does not exist", name)
+	}
+
+	file := fs.Open(name)
+	defer file.Close()
+	return readAll(t, file)
+}
@@ -0,0 +1,429 @@
+package concrete
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/device"
+)
+
+var errInjected = errors.New("injected")
+
+var (
+	crashFiles     = []string{"a", "b", "c", "d"}
+	crashSnapshots = []string{"s1", "s2"}
+)
+
+// The contents of the file system as of the last operation which
+// finished without an error
+type crashModel struct {
+	files     map[string][]byte
+	snapshots map[string]map[string][]byte
+}
+
+func newCrashModel() *crashModel {
+	return &crashModel{
+		files:     make(map[string][]byte),
+		snapshots: make(map[string]map[string][]byte),
+	}
+}
+
+// Performs a random operation on both the file system and the model.
+// The names the operation touched are returned with any error, if
+// there is one the model is left as it was.
+func (m *crashModel) step(r *rand.Rand, fs FileSystem) ([]string, error) {
+	name := crashFiles[r.Intn(len(crashFiles))]
+	snap := crashSnapshots[r.Intn(len(crashSnapshots))]
+
+	switch op := r.Intn(14); {
+	case op < 5:
+		old := m.files[name]
+		pos := r.Intn(len(old) + 1)
+		data := crashData(r)
+
+		file := fs.Open(name)
+		if file == nil {
+			return []string{name}, errors.New("could not open " + name)
+		}
+		file.Seek(int64(pos), int(gofs.Beginning))
+		if _, err := file.Write(data); err != nil {
+			return []string{name}, err
+		} else if err = file.Close(); err != nil {
+			return []string{name}, err
+		}
+
+		m.files[name] = overwrite(old, pos, data)
+
+	case op < 6:
+		if err := fs.Delete(name); err != nil {
+			return []string{name}, err
+		}
+		delete(m.files, name)
+
+	case op < 8:
+		dst := crashFiles[r.Intn(len(crashFiles))]
+		if _, exists := m.files[name]; !exists {
+			return nil, nil
+		} else if _, exists = m.files[dst]; exists {
+			return nil, nil
+		} else if err := fs.Clone(name, dst); err != nil {
+			return []string{dst}, err
+		}
+		m.files[dst] = m.files[name]
+
+	case op < 9:
+		if _, exists := m.snapshots[snap]; exists {
+			return nil, nil
+		} else if err := fs.Snapshot(snap); err != nil {
+			return []string{snap}, err
+		}
+
+		files := make(map[string][]byte)
+		for name, contents := range m.files {
+			files[name] = contents
+		}
+		m.snapshots[snap] = files
+
+	case op < 10:
+		if _, exists := m.snapshots[snap]; !exists {
+			return nil, nil
+		} else if err := fs.DeleteSnapshot(snap); err != nil {
+			return []string{snap}, err
+		}
+		delete(m.snapshots, snap)
+
+	case op < 11:
+		// Every file keeps its contents whether or not it finishes
+		return nil, fs.Compact(nil)
+
+	case op < 12:
+		return m.commit(r, fs, name)
+
+	case op < 13:
+		versions := fs.Versions(name)
+		if len(versions) == 0 {
+			return nil, nil
+		}
+
+		// The model does not keep versions, their contents are read
+		// back instead
+		number := versions[r.Intn(len(versions))].Number
+		file, err := fs.OpenVersion(name, number)
+		if err != nil {
+			return []string{name}, err
+		}
+		contents, err := io.ReadAll(io.LimitReader(file, file.Size()))
+		file.Close()
+		if err != nil {
+			return []string{name}, err
+		} else if err = fs.RestoreVersion(name, number); err != nil {
+			return []string{name}, err
+		}
+		m.files[name] = contents
+
+	default:
+		if err := fs.PruneVersions(name, r.Intn(3)); err != nil {
+			return []string{name}, err
+		}
+	}
+	return nil, nil
+}
+
+// Writes to a file in a transaction and sometimes renames it over
+// another file before committing
+func (m *crashModel) commit(r *rand.Rand, fs FileSystem, name string) ([]string, error) {
+	dst := crashFiles[r.Intn(len(crashFiles))]
+	touched := []string{name, dst}
+
+	tx, err := fs.Begin()
+	if err != nil {
+		return touched, err
+	}
+
+	old := m.files[name]
+	pos := r.Intn(len(old) + 1)
+	data := crashData(r)
+
+	file := tx.Open(name)
+	if file == nil {
+		tx.Rollback()
+		return touched, errors.New("could not open " + name)
+	}
+	file.Seek(int64(pos), int(gofs.Beginning))
+	if _, err = file.Write(data); err != nil {
+		tx.Rollback()
+		return touched, err
+	} else if err = file.Close(); err != nil {
+		tx.Rollback()
+		return touched, err
+	}
+
+	rename := r.Intn(2) == 0
+	if rename {
+		if err = tx.Rename(name, dst); err != nil {
+			tx.Rollback()
+			return touched, err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		return touched, err
+	}
+
+	contents := overwrite(old, pos, data)
+	if rename && dst != name {
+		delete(m.files, name)
+		name = dst
+	}
+	m.files[name] = contents
+	return nil, nil
+}
+
+// Returns up to three blocks of random data
+func crashData(r *rand.Rand) []byte {
+	data := make([]byte, 1+r.Intn(3*_DataSize))
+	r.Read(data)
+	return data
+}
+
+// Returns a copy of old with data written at pos
+func overwrite(old []byte, pos int, data []byte) []byte {
+	contents := append([]byte(nil), old...)
+	if end := pos + len(data); end > len(contents) {
+		contents = append(contents, make([]byte, end-len(contents))...)
+	}
+	copy(contents[pos:], data)
+	return contents
+}
+
+// Checks that the files match the model, except for those whose
+// contents are not known
+func checkFiles(t *testing.T, fs gofs.FileSystem, files map[string][]byte, unknown map[string]bool) {
+	t.Helper()
+
+	for _, name := range crashFiles {
+		if unknown[name] {
+			continue
+		}
+
+		want, exists := files[name]
+		if fs.Exists(name) != exists {
+			t.Fatalf("%s: exists is %v, want %v", name, !exists, exists)
+		} else if !exists {
+			continue
+		}
+
+		file := fs.Open(name)
+		got := make([]byte, file.Size()+1)
+		n, err := io.ReadFull(file, got)
+		file.Close()
+
+		if err != io.ErrUnexpectedEOF && err != io.EOF {
+			t.Fatalf("%s: %v", name, err)
+		} else if !bytes.Equal(got[:n], want) {
+			t.Fatalf("%s: contents differ", name)
+		}
+	}
+}
+
+// Checks that every block is either free or in use by the chains of
+// the name table, and that the reference counts match the links to
+// each block
+func checkBlocks(t *testing.T, fSys *fileSystemImpl) {
+	t.Helper()
+
+	total := fSys.sizeInBytes / _BlockSize
+	free := make(map[int64]bool)
+	for curr := fSys.indexOfFirstFree; curr != _NullIndex; {
+		if free[curr] {
+			t.Fatalf("free list loops at block %d", curr)
+		}
+		free[curr] = true
+
+		node, err := fSys.getBlock(curr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		curr = node.next
+	}
+
+	if int64(len(free)) != fSys.numberFreeNodes {
+		t.Fatalf("%d blocks on the free list, header says %d", len(free), fSys.numberFreeNodes)
+	}
+
+	used := make(map[int64]bool)
+	incoming := make(map[int64]int64)
+	for _, info := range fSys.entries() {
+		if info.first != _NullIndex {
+			incoming[info.first]++
+		}
+
+		var count int64
+		last := int64(_NullIndex)
+		for curr := info.first; curr != _NullIndex; count++ {
+			if free[curr] {
+				t.Fatalf("%s uses free block %d", info.name, curr)
+			} else if count > blocksFor(info.size) {
+				t.Fatalf("%s has more blocks than its size needs", info.name)
+			}
+
+			node, err := fSys.getBlock(curr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !used[curr] && node.next != _NullIndex {
+				incoming[node.next]++
+			}
+			used[curr] = true
+			last, curr = curr, node.next
+		}
+
+		if count != blocksFor(info.size) {
+			t.Fatalf("%s has %d blocks for %d bytes", info.name, count, info.size)
+		} else if last != info.last {
+			t.Fatalf("%s ends at block %d, not %d", info.name, last, info.last)
+		}
+	}
+
+	for index, count := range incoming {
+		if fSys.refCount(index) != count {
+			t.Fatalf("block %d is counted %d times but linked %d times", index, fSys.refCount(index), count)
+		}
+	}
+
+	if int64(len(free)+len(used)) != total {
+		t.Fatalf("%d free and %d used of %d blocks", len(free), len(used), total)
+	}
+}
+
+// Runs random operations until one fails, either by cutting the power
+// or by an injected error, then crashes the disk and checks what is
+// found on it when the file system is opened again
+func crash(t *testing.T, seed int64) {
+	r := rand.New(rand.NewSource(seed))
+	disk := device.NewFaultyDisk()
+
+	var opts []Option
+	if r.Intn(2) == 0 {
+		opts = append(opts, Versioned())
+	}
+	open := func(disk *device.FaultyDisk) FileSystem {
+		fs, err := Open("", "crash", append(opts, Storage(disk.Open))...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	}
+
+	fs := open(disk)
+	m := newCrashModel()
+
+	// Build up some state before anything goes wrong
+	for i, n := 0, r.Intn(20); i < n; i++ {
+		if _, err := m.step(r, fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ops := []device.Op{device.OpRead, device.OpWrite, device.OpResize, device.OpSync}
+	op := ops[r.Intn(len(ops))]
+	at := disk.Count(op) + 1 + int64(r.Intn(50))
+	if r.Intn(4) == 0 {
+		disk.Inject(device.FailAt(op, at, errInjected))
+	} else {
+		disk.Inject(device.PowerOffAt(op, at))
+	}
+
+	unknown := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		names, err := m.step(r, fs)
+		if err != nil {
+			for _, name := range names {
+				unknown[name] = true
+			}
+			break
+		}
+	}
+
+	disk.PowerOff()
+	fs = open(disk.Crash(r, true))
+	defer fs.Shutdown(context.Background())
+
+	checkBlocks(t, fs.(*fileSystemImpl))
+	checkFiles(t, fs, m.files, unknown)
+
+	for name, files := range m.snapshots {
+		if unknown[name] {
+			continue
+		}
+
+		view, err := fs.OpenSnapshot(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkFiles(t, view, files, nil)
+		view.Shutdown(context.Background())
+	}
+
+	// What was recovered can be used again
+	for name := range unknown {
+		fs.Delete(name)
+		fs.DeleteSnapshot(name)
+		delete(m.files, name)
+		delete(m.snapshots, name)
+	}
+
+	for i := 0; i < 20; i++ {
+		if _, err := m.step(r, fs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+	checkFiles(t, fs, m.files, nil)
+}
+
+func TestCrash(t *testing.T) {
+	seeds := int64(100)
+	if testing.Short() {
+		seeds = 20
+	}
+
+	for seed := int64(0); seed < seeds; seed++ {
+		t.Run(fmt.Sprint(seed), func(t *testing.T) {
+			crash(t, seed)
+		})
+	}
+}
+
+func TestCrash_CleanShutdown(t *testing.T) {
+	disk := device.NewFaultyDisk()
+
+	fs, err := Open("", "crash", Storage(disk.Open))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := fs.Open("test")
+	file.Write(bytes.Repeat([]byte("data"), _DataSize))
+	file.Close()
+
+	if err = fs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything was synced so nothing is lost
+	fs, err = Open("", "crash", Storage(disk.Crash(rand.New(rand.NewSource(0)), true).Open))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	checkBlocks(t, fs.(*fileSystemImpl))
+	checkFiles(t, fs, map[string][]byte{"test": bytes.Repeat([]byte("data"), _DataSize)}, nil)
+}
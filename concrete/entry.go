@@ -3,8 +3,10 @@ package concrete
 import (
 	"errors"
 	"os"
+	"sync"
 
-	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/device"
+	"github.com/deathly809/gofs/internal/fsutil"
 )
 
 /*
@@ -15,20 +17,73 @@ import (
 
        The name file contains a fixed length header.
 
-       [SIGNATURE:NUMBER_OF_FILES]
+       [SIGNATURE:VERSION:NUMBER_OF_FILES:SIZE:FIRST_FREE:NUMBER_FREE]
 
        where the size of each in bytes is:
 
-       [8:8]
+       [8:12:8:8:8:8]
 
        After the header there are a fixed number of files to read as specified
        by the header.  Each file has an entry of the form:
 
-       [NAME : FIRST : LAST : SIZE]
+       [NAME_LENGTH : NAME : SIZE : FIRST : LAST : MODIFIED : CREATED]
 
        where the size of each in bytes is:
 
-       [256:8:8:8]
+       [2:256:8:8:8:8:8]
+
+       The file entries are followed by the snapshots.  Each snapshot
+       has a header of the form:
+
+       [NAME_LENGTH : NAME : CREATED : NUMBER_OF_FILES]
+
+       where the size of each in bytes is:
+
+       [2:256:8:8]
+
+       followed by a file entry for each of its files.  Next are the
+       reference counts of blocks shared by more than one chain:
+
+       [NUMBER_OF_COUNTS : (INDEX : COUNT)...]
+
+       where the size of each in bytes is:
+
+       [8:(8:8)...]
+
+       Last are the versions of files.  The versions of each file
+       are preceded by the name of the file, the number of the newest
+       version ever recorded and how many versions follow.  Each
+       version is a header followed by a file entry:
+
+       [NUMBER_OF_FILES : (NAME_LENGTH : NAME : LATEST : NUMBER_OF_VERSIONS :
+           (NUMBER : RECORDED : ENTRY)...)...]
+
+       where the size of each in bytes is:
+
+       [8:(2:256:8:8:(8:8:298)...)...]
+
+       The data file is a list of blocks.  Each block has the form:
+
+       [PREV : NEXT : DATA]
+
+       where the size of each in bytes is:
+
+       [8:8:4080]
+
+       The journal makes writing the name file atomic.  A new name table
+       is first written to the journal, then to the name file.  The
+       journal has a header of the form:
+
+       [SIGNATURE:STATE:LENGTH:CHECKSUM]
+
+       where the size of each in bytes is:
+
+       [8:8:8:4]
+
+       followed by LENGTH bytes of name table when the state says one is
+       pending.  A file system which was not shut down cleanly has its
+       free list and reference counts rebuilt from the name table when
+       it is next opened.
 
 */
 
@@ -36,13 +91,34 @@ func readNames(f *os.File) map[string]int {
 	return nil
 }
 
+// Returns a file system with no files which is not backed by
+// anything yet
+func newFileSystem() *fileSystemImpl {
+	result := &fileSystemImpl{}
+	result.files = make(map[string]*fileInfo)
+	result.openFiles = make(map[*fileInfo][]*file)
+	result.refs = make(map[int64]int64)
+	result.snapshots = make(map[string]*snapshot)
+	result.versions = make(map[string]*history)
+	result.transactions = make(map[*transaction]bool)
+	result.views = make(map[*fileSystemImpl]string)
+	result.lock = &sync.Mutex{}
+	result.state = fsutil.NewState(result.lock)
+	result.open = device.OpenMmap
+	return result
+}
+
 // Open creates the default filesystem
-func Open(directory, name string) (gofs.FileSystem, error) {
+func Open(directory, name string, opts ...Option) (FileSystem, error) {
 
-	result := &int{}
+	result := newFileSystem()
 	result.fsDirectory = directory
 	result.fsName = name
 
+	for _, opt := range opts {
+		opt(result)
+	}
+
 	err := result.init()
 
 	if err != nil {
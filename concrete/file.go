@@ -2,221 +2,381 @@ package concrete
 
 import (
 	"errors"
+	"fmt"
+	"io"
 	"time"
 
 	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
 	"github.com/deathly809/gomath"
 )
 
-const (
-	_Open   = iota
-	_Closed = iota
-)
-
 // Meta-data about each file
 type fileInfo struct {
 	name         string
-	size         int
-	first        int
-	last         int
+	size         int64
+	first        int64
+	last         int64
 	created      time.Time
 	lastModified time.Time
+	deleted      bool  // removed from the name table while still open
+	owned        int64 // number of leading blocks shared with nothing else
+	ownedTail    int64 // the last of the owned blocks
 }
 
-// Logical information about an open file
-type file struct {
-	fs     *fileSystemImpl
-	pos    int
-	curr   fileNode
-	fInfo  fileInfo
-	isnew  bool
-	status int
+// Returns a copy of the information persisted for the file
+func (info *fileInfo) clone() *fileInfo {
+	return &fileInfo{
+		name:         info.name,
+		size:         info.size,
+		first:        info.first,
+		last:         info.last,
+		created:      info.created,
+		lastModified: info.lastModified,
+	}
 }
 
-func (f *file) Close() error {
-	f.status = _Closed
-	return nil
+// Logical information about an open file
+type file struct {
+	fs       *fileSystemImpl
+	pos      int64
+	curr     fileNode // block containing pos, id is _NullIndex if not loaded
+	currIdx  int64    // index of curr in the block chain
+	fInfo    *fileInfo
+	isnew    bool
+	modified bool
+	readOnly bool         // a handle to a version of the file
+	tx       *transaction // the transaction the handle was opened in
+	status   int
 }
 
-func (f *file) positionsInSameBlock(posA, posB int) bool {
-	return (posA / _BlockSize) == (posB / _BlockSize)
+// The number of blocks needed to hold size bytes
+func blocksFor(size int64) int64 {
+	return (size + _DataSize - 1) / _DataSize
 }
 
-func (f *file) moveDown(bytes int) {
-	finalPos := f.pos - bytes
-
-	if f.positionOutOfBounds(finalPos) {
-
-		finalPos = -finalPos
-		blocksNeeded := int((finalPos + _BlockSize - 1) / _BlockSize)
-		head, tail := f.fs.allocateBlocks(blocksNeeded)
-
-		f.Seek(0, gofs.Beginning)
+func (f *file) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
 
-		tail.next = f.curr.id
-		f.curr.prev = tail.id
+	if f.status == fsutil.Closed {
+		return errors.New("File already closed")
+	}
+	f.status = fsutil.Closed
 
-		f.fInfo.first = head.id
-		f.fInfo.size += finalPos
+	if f.fs.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+	f.fs.state.Unlock(f)
 
-		f.curr = head
-		f.pos = finalPos
-	} else {
+	if err := f.fs.closeHandle(f); err != nil {
+		return err
+	}
 
-		currMove := f.pos % _BlockSize
-		f.pos -= currMove
-		bytes -= currMove
+	if f.modified && f.fs.versioned && !f.fInfo.deleted && f.tx == nil {
+		f.fs.recordVersion(f.fInfo)
+	}
 
-		for bytes >= _BlockSize {
-			f.curr = f.fs.getBlock(f.curr.prev)
-			currMove := gomath.Minint(_BlockSize, bytes)
-			f.pos -= currMove
-			bytes -= currMove
-		}
+	if f.modified || f.fInfo.deleted {
+		return f.fs.writeNames()
 	}
+	return nil
 }
 
-func (f *file) moveUp(bytes int) {
-	finalPos := f.pos + bytes
-
-	if f.positionOutOfBounds(finalPos) {
-		bytesToGrowBy := finalPos - f.Size()
-		blocksNeeded := (bytesToGrowBy + _BlockSize - 1) / _BlockSize
-		head, tail := f.fs.allocateBlocks(blocksNeeded)
+// Loads the block with the given index in the chain into curr.
+// The block is always read again so changes made through other
+// handles are seen.
+func (f *file) seekBlock(index int64) error {
+	start := f.curr.id
+	if start == _NullIndex || index < f.currIdx {
+		start, f.currIdx = f.fInfo.first, 0
+	}
 
-		f.Seek(0, gofs.End)
-		head.prev = f.curr.id
-		head.prev = f.curr.id
+	node, err := f.fs.getBlock(start)
+	for err == nil && f.currIdx < index {
+		node, err = f.fs.getBlock(node.next)
+		f.currIdx++
+	}
 
-		f.fInfo.last = tail.id
-		f.fInfo.size += bytesToGrowBy
+	if err != nil {
+		f.curr = fileNode{id: _NullIndex}
+		return err
+	}
 
-		f.curr = tail
-		f.pos = finalPos
-	} else {
+	f.curr = node
+	return nil
+}
 
-		currMove := f.pos % _BlockSize
-		f.pos += currMove
-		bytes -= currMove
+// Makes sure none of the blocks up to and including the one with
+// the given index in the chain are shared, so they may be changed.
+// Shared blocks are copied and the copy points at the same next
+// block, which is then shared in turn.
+func (f *file) own(index int64) error {
+	info := f.fInfo
+	if index < info.owned {
+		return nil
+	}
 
-		for bytes >= _BlockSize {
-			f.curr = f.fs.getBlock(f.curr.prev)
-			currMove := gomath.Minint(_BlockSize, bytes)
-			f.pos += currMove
-			bytes -= currMove
+	prev := fileNode{id: _NullIndex}
+	curr := info.first
+	if info.owned > 0 {
+		node, err := f.fs.getBlock(info.ownedTail)
+		if err != nil {
+			return err
 		}
+		prev, curr = node, node.next
 	}
-}
 
-func (f *file) positionOutOfBounds(pos int) bool {
-	return pos >= f.fInfo.size || pos < 0
-}
+	for i := info.owned; i <= index; i++ {
+		node, err := f.fs.getBlock(curr)
+		if err != nil {
+			return err
+		}
 
-func (f *file) growBy(size int) {
-	currPos := f.pos
-	endPos := f.fInfo.size + size
-	f.Seek(-endPos, gofs.End)
-	f.Seek(currPos, gofs.Beginning)
+		if f.fs.refCount(curr) > 1 {
+			if node, err = f.fs.copyBlock(node); err != nil {
+				return err
+			}
+
+			if prev.id == _NullIndex {
+				info.first = node.id
+			} else {
+				prev.next = node.id
+				if err = f.fs.writeNode(prev); err != nil {
+					return err
+				}
+			}
+
+			if curr == info.last {
+				info.last = node.id
+			}
+			f.fs.invalidate(info)
+		}
+
+		prev, curr = node, node.next
+		info.owned, info.ownedTail = i+1, node.id
+	}
+	return nil
 }
 
-func (f *file) singleBlockWriteAtPos(data []byte) {
-	offset := f.pos % _BlockSize
-	bytesToWrite := gomath.Minint(_BlockSize-offset, len(data))
+// Appends numBlocks empty blocks to the end of the file
+func (f *file) growBy(numBlocks int64) error {
+	info := f.fInfo
+	have := blocksFor(info.size)
+	if have > 0 {
+		if err := f.own(have - 1); err != nil {
+			return err
+		}
+	}
 
-	copy(f.curr.data[offset:bytesToWrite], data)
-}
+	head, tail, err := f.fs.allocateBlocks(numBlocks, info.last)
+	if err != nil {
+		return err
+	}
 
-func (f *file) singleBlockReadFromPos(data []byte) {
-	offset := f.pos % _BlockSize
-	bytesToRead := gomath.Minint(_BlockSize-offset, len(data))
+	if info.first == _NullIndex {
+		info.first = head
+	}
+	info.last = tail
+	info.owned, info.ownedTail = have+numBlocks, tail
 
-	data = data[:bytesToRead]
-	copy(data, f.curr.data[offset:bytesToRead])
+	return nil
 }
 
 func (f *file) Write(data []byte) (bytesWritten int, err error) {
-	if f.status == _Closed {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
 		bytesWritten, err = 0, errors.New("Cannot write to a closed file")
 	} else if data == nil {
 		bytesWritten, err = 0, errors.New("Null pointer exception")
-	} else {
+	} else if f.readOnly || f.fs.readOnly {
+		bytesWritten, err = 0, gofs.ErrReadOnly
+	} else if err = f.fs.state.BeginIO(f); err == nil {
+		defer f.fs.state.EndIO()
+		bytesWritten, err = f.write(data)
+	}
+
+	return bytesWritten, err
+}
+
+func (f *file) write(data []byte) (bytesWritten int, err error) {
+	finalPos := f.pos + int64(len(data))
 
-		bytesWritten = len(data)
-		finalPos := f.pos + len(data)
+	have, need := blocksFor(f.fInfo.size), blocksFor(finalPos)
+	if need > have {
+		err = f.growBy(need - have)
+	}
 
-		if f.positionOutOfBounds(finalPos) {
-			f.growBy(finalPos - f.Size())
+	for err == nil && bytesWritten < len(data) {
+		if err = f.own(f.pos / _DataSize); err != nil {
+			break
+		} else if err = f.seekBlock(f.pos / _DataSize); err == nil {
+			n := copy(f.curr.data[f.pos%_DataSize:], data[bytesWritten:])
+			if err = f.fs.writeNode(f.curr); err != nil {
+				f.curr = fileNode{id: _NullIndex}
+				break
+			}
+
+			bytesWritten += n
+			f.pos += int64(n)
 		}
+	}
 
-		bytesToWriteToBlock := _DataSize - (f.pos % _DataSize)
-		for f.pos < finalPos {
+	f.fInfo.size = gomath.MaxInt64(f.fInfo.size, f.pos)
+	f.fInfo.lastModified = time.Now()
+	f.modified = true
 
-			f.singleBlockWriteAtPos(data)
-			f.Seek(bytesToWriteToBlock, gofs.Current)
+	if f.tx != nil {
+		f.tx.changed[f.fInfo] = true
+	}
+	return bytesWritten, err
+}
 
-			data = data[bytesToWriteToBlock:]
-			bytesToWriteToBlock = gomath.Minint(_DataSize, len(data))
+// Publish writes the data at the position of the handle so that the
+// file has either all of it or none of it.  The blocks it changes are
+// copied and written first, the file is then switched over to the
+// copies in a single write of the name table.  A handle opened in a
+// transaction is already staged by it and writes as usual.
+func (f *file) Publish(data []byte) (bytesWritten int, err error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return 0, errors.New("Cannot write to a closed file")
+	} else if data == nil {
+		return 0, errors.New("Null pointer exception")
+	} else if f.readOnly || f.fs.readOnly {
+		return 0, gofs.ErrReadOnly
+	} else if err = f.fs.state.BeginIO(f); err != nil {
+		return 0, err
+	}
+	defer f.fs.state.EndIO()
 
-		}
+	if f.tx != nil {
+		return f.write(data)
 	}
+	return f.publish(data)
+}
 
-	return bytesWritten, err
+func (f *file) publish(data []byte) (int, error) {
+	// The staged copy shares the blocks of the file until it writes
+	// to them
+	info := f.fInfo
+	staged := info.clone()
+	f.fs.incRef(staged.first)
+	info.owned = 0
+
+	stage := &file{
+		fs:     f.fs,
+		pos:    f.pos,
+		curr:   fileNode{id: _NullIndex},
+		fInfo:  staged,
+		status: fsutil.Open,
+	}
+	n, err := stage.write(data)
+	if err != nil {
+		return 0, f.fs.unstage(staged, err)
+	}
+
+	old := *info
+	info.first, info.last = staged.first, staged.last
+	info.size, info.lastModified = staged.size, staged.lastModified
+	info.owned, info.ownedTail = staged.owned, staged.ownedTail
+	f.fs.invalidate(info)
+
+	if err = f.fs.writeNames(); err != nil {
+		*info = old
+		f.fs.invalidate(info)
+		return 0, f.fs.unstage(staged, err)
+	}
+	f.pos = stage.pos
+	f.modified = true
+
+	// The blocks only the old contents used are freed once the name
+	// table is written again
+	return n, f.fs.freeBlocks(old.first)
+}
+
+// Frees the blocks of a staged copy which was not published and
+// returns the error which stopped it
+func (fSys *fileSystemImpl) unstage(staged *fileInfo, err error) error {
+	if e := fSys.freeBlocks(staged.first); e != nil {
+		return e
+	}
+	return err
 }
 
 // Read data into a given byte array
 // If the array is null an error is returned
 func (f *file) Read(data []byte) (bytesRead int, err error) {
-	if f.status == _Closed {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
 		bytesRead, err = 0, errors.New("Cannot read from a closed file")
 	} else if data == nil {
 		bytesRead, err = 0, errors.New("Null pointer exception")
-	} else {
+	} else if err = f.fs.state.BeginIO(f); err == nil {
+		defer f.fs.state.EndIO()
+		bytesRead, err = f.read(data)
+	}
+	return bytesRead, err
+}
+
+func (f *file) read(data []byte) (bytesRead int, err error) {
+	if len(data) > 0 && f.pos >= f.fInfo.size {
+		return 0, io.EOF
+	}
 
-		finalPos := f.pos + gomath.Minint(int(len(data)), f.fInfo.size-f.pos)
+	finalPos := gomath.MinInt64(f.pos+int64(len(data)), f.fInfo.size)
 
-		bytesToReadFromBlock := _DataSize - (f.pos % _DataSize)
-		for f.pos < finalPos {
-			f.singleBlockReadFromPos(data)
-			f.Seek(bytesToReadFromBlock, gofs.Current)
+	for err == nil && f.pos < finalPos {
+		if err = f.seekBlock(f.pos / _DataSize); err == nil {
+			offset := f.pos % _DataSize
+			length := gomath.MinInt64(_DataSize-offset, finalPos-f.pos)
+			n := copy(data[bytesRead:], f.curr.data[offset:offset+length])
 
-			data = data[bytesToReadFromBlock:]
-			bytesToReadFromBlock = gomath.Minint(_DataSize, int(len(data)))
+			bytesRead += n
+			f.pos += int64(n)
 		}
+	}
 
-		bytesRead, err = finalPos-f.pos, nil
+	if err != nil {
+		bytesRead = 0
 	}
 	return bytesRead, err
 }
 
 // Seek will move to a specific spot in the file.  If the
-// spot is not within the file we expand the file to include
-// it.
-//
-// If we seek before the beginning file we prepend zeros
-// If we seek after the end of the file we append zeros
-//
-func (f *file) Seek(offset int, from gofs.FileOffset) {
-	fSys := f.fs
-
-	switch from {
+// spot is not within the file it is clamped to either the
+// beginning or the end of the file.
+func (f *file) Seek(offset int64, from int) (int64, error) {
+	var base int64
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return 0, errors.New("Cannot seek in a closed file")
+	} else if f.fs.state.Status == fsutil.Closed {
+		return 0, gofs.ErrClosed
+	}
+
+	switch gofs.FileOffset(from) {
 	case gofs.Beginning:
-		f.curr = fSys.getBlock(f.fInfo.first)
-		f.pos = 0
+		base = 0
+	case gofs.Current:
+		base = f.pos
 	case gofs.End:
-		f.curr = fSys.getBlock(f.fInfo.last)
-		f.pos = f.fInfo.size
+		base = f.fInfo.size
+	default:
+		return f.pos, fmt.Errorf("invalid seek origin: %d", from)
 	}
 
-	finalPos := f.pos + offset
-	if !f.positionsInSameBlock(finalPos, f.pos) {
-		if offset < 0 {
-			f.moveDown(-offset)
-		} else {
-			f.moveUp(offset)
-		}
-	} else {
-		f.pos = finalPos
-	}
+	f.pos = gomath.MaxInt64(0, gomath.MinInt64(base+offset, f.fInfo.size))
+	return f.pos, nil
 }
 
 func (f *file) IsNew() bool {
@@ -227,6 +387,9 @@ func (f *file) Name() string {
 	return f.fInfo.name
 }
 
-func (f *file) Size() int {
+func (f *file) Size() int64 {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
 	return f.fInfo.size
 }
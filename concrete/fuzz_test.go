@@ -0,0 +1,233 @@
+package concrete
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/device"
+)
+
+// The suffixes of the files backing a file system
+var fuzzSuffixes = []string{"-name", "-data", "-journal"}
+
+// Returns the images of a file system with files, a clone, a
+// snapshot and versions in it
+func fuzzSeed(f *testing.F) [][]byte {
+	dir := f.TempDir()
+
+	fs, err := Open(dir, "seed", Storage(device.OpenFile), Versioned())
+	if err != nil {
+		f.Fatal(err)
+	}
+
+	for i, name := range []string{"a", "b", "c"} {
+		file := fs.Open(name)
+		file.Write(make([]byte, (i+1)*_DataSize/2))
+		file.Close()
+	}
+	fs.Clone("a", "d")
+	fs.Snapshot("s")
+
+	file := fs.Open("b")
+	file.Write([]byte("changed"))
+	file.Close()
+
+	if err = fs.Shutdown(context.Background()); err != nil {
+		f.Fatal(err)
+	}
+
+	var images [][]byte
+	for _, suffix := range fuzzSuffixes {
+		image, err := os.ReadFile(filepath.Join(dir, "seed"+suffix))
+		if err != nil {
+			f.Fatal(err)
+		}
+		images = append(images, image)
+	}
+	return images
+}
+
+// Reads a bounded amount of every file the file system claims to have
+func fuzzRead(fs gofs.FileSystem, names []string) {
+	for _, name := range names {
+		fs.Stat(name)
+		if file := fs.Open(name); file != nil {
+			io.CopyN(io.Discard, file, 4*_BlockSize)
+			file.Close()
+		}
+	}
+}
+
+// Opens the images read-only and then for writing, reading whatever
+// was loaded, writing to it and then deleting and compacting it.  Damaged images must return errors,
+// not panic.  The images are large, so the fuzzer stops executing
+// for a few seconds while it minimizes each new input it finds,
+// unless -fuzzminimizetime is lowered.
+func FuzzOpen(f *testing.F) {
+	seed := fuzzSeed(f)
+
+	// Most of the data file is free blocks, the rest is kept small
+	// so it can be mutated quickly.  With the journal dirty the free
+	// list is rebuilt for the blocks which are left.
+	data := seed[1][:16*_BlockSize]
+	dirty := encodeJournal(_JournalDirty, nil)
+
+	f.Add(seed[0], data, dirty)
+	f.Add(seed[0], data, seed[2])
+	f.Add(seed[0], data, []byte{})
+	f.Add(seed[0], []byte{}, dirty)
+	f.Add([]byte{}, []byte{}, []byte{})
+
+	f.Fuzz(func(t *testing.T, names, data, journal []byte) {
+		dir := t.TempDir()
+		for i, image := range [][]byte{names, data, journal} {
+			if err := os.WriteFile(filepath.Join(dir, "fuzz"+fuzzSuffixes[i]), image, 0644); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, opts := range [][]Option{{ReadOnly()}, nil} {
+			fs, err := Open(dir, "fuzz", append(opts, Storage(device.OpenFile))...)
+			if err != nil {
+				continue
+			}
+
+			fSys := fs.(*fileSystemImpl)
+			fuzzRead(fs, sortedNames(fSys.files))
+
+			for _, info := range fs.Snapshots() {
+				if view, err := fs.OpenSnapshot(info.Name); err == nil {
+					fuzzRead(view, sortedNames(view.(*fileSystemImpl).files))
+					view.Shutdown(context.Background())
+				}
+			}
+
+			for _, name := range sortedVersionNames(fSys.versions) {
+				for _, v := range fs.Versions(name) {
+					if file, err := fs.OpenVersion(name, v.Number); err == nil {
+						io.CopyN(io.Discard, file, 4*_BlockSize)
+						file.Close()
+					}
+				}
+			}
+
+			// Writing uses the free list and the reference counts
+			if !fSys.readOnly {
+				for _, name := range append(sortedNames(fSys.files), "new") {
+					if file := fs.Open(name); file != nil {
+						file.Seek(_DataSize/2, int(gofs.Beginning))
+						file.Write(make([]byte, _DataSize))
+						file.Close()
+					}
+				}
+
+				// Deleting and compacting walk the chains to the end
+				fs.Delete("new")
+				if names := sortedNames(fSys.files); len(names) > 0 {
+					fs.Delete(names[0])
+				}
+				fs.Compact(nil)
+				for _, info := range fs.Snapshots() {
+					fs.DeleteSnapshot(info.Name)
+				}
+			}
+
+			fs.Shutdown(context.Background())
+		}
+	})
+}
+
+// Counts in the name table larger than the file could hold are
+// rejected before anything is loaded
+func TestOpen_Counts(t *testing.T) {
+	offsets := map[string]int64{
+		"files":            _SignatureSize + _VersionBytes,
+		"snapshots":        _HeaderSize,
+		"reference counts": _HeaderSize + 8,
+		"versioned files":  _HeaderSize + 16,
+	}
+
+	for what, offset := range offsets {
+		dir := t.TempDir()
+		fs, err := Open(dir, "counts", Storage(device.OpenFile))
+		if err != nil {
+			t.Fatal(err)
+		} else if err = fs.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, "counts-name")
+		image, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint64(image[offset:], 1<<40)
+		if err = os.WriteFile(path, image, 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		if fs, err = Open(dir, "counts", Storage(device.OpenFile)); err == nil {
+			fs.Shutdown(context.Background())
+			t.Errorf("opened with too many %s", what)
+		} else if !strings.Contains(err.Error(), "too many "+what) {
+			t.Errorf("too many %s: %v", what, err)
+		}
+	}
+}
+
+func TestOpen_Chains(t *testing.T) {
+	damage := map[string]func(fSys *fileSystemImpl, info *fileInfo) error{
+		"loops": func(fSys *fileSystemImpl, info *fileInfo) error {
+			return fSys.concatNodes(info.last, info.first)
+		},
+		"is longer than": func(fSys *fileSystemImpl, info *fileInfo) error {
+			return fSys.concatNodes(info.last, fSys.indexOfFirstFree)
+		},
+		"ends at": func(fSys *fileSystemImpl, info *fileInfo) error {
+			info.last = info.first
+			return nil
+		},
+	}
+
+	for what, change := range damage {
+		dir := t.TempDir()
+		fs, err := Open(dir, "chains", Storage(device.OpenFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+		fSys := fs.(*fileSystemImpl)
+		writeFile(t, fs, "a", strings.Repeat("a", 2*_DataSize))
+
+		if err = change(fSys, fSys.files["a"]); err != nil {
+			t.Fatal(err)
+		} else if err = fs.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if fs, err = Open(dir, "chains", Storage(device.OpenFile)); err == nil {
+			fs.Shutdown(context.Background())
+			t.Errorf("opened when the chain %s", what)
+		} else if !strings.Contains(err.Error(), "chain "+what) {
+			t.Errorf("chain %s: %v", what, err)
+		}
+	}
+
+	// A chain which loops is not freed forever
+	fs := newFS(t, InMemory())()
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+	writeFile(t, fs, "a", strings.Repeat("a", 2*_DataSize))
+
+	info := fSys.files["a"]
+	if err := fSys.concatNodes(info.last, info.first); err != nil {
+		t.Fatal(err)
+	} else if err = fs.Delete("a"); err == nil {
+		t.Error("deleted a chain which loops")
+	}
+}
@@ -0,0 +1,73 @@
+package concrete
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestHandles_DeleteWhileOpen(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	contents := strings.Repeat("old ", _DataSize)
+	writeFile(t, fs, "test", contents)
+	first := fs.Open("test")
+	second := fs.Open("test")
+	free := fSys.numberFreeNodes
+
+	// The name goes at once
+	if err := fs.Delete("test"); err != nil {
+		t.Fatal(err)
+	} else if fs.Exists("test") || fs.Stat("test") != nil {
+		t.Fatal("test exists after it was deleted")
+	} else if fSys.numberFreeNodes != free {
+		t.Fatal("blocks freed while the file is open")
+	}
+
+	// The blocks of the deleted file are not reused by a new one
+	writeFile(t, fs, "test", strings.Repeat("new ", _DataSize))
+	if got := readAll(t, first); got != contents {
+		t.Error("open handle reads different contents after the delete")
+	}
+
+	first.Close()
+	if got := readAll(t, second); got != contents {
+		t.Error("second handle reads different contents after the first closed")
+	} else if fSys.numberFreeNodes != free-blocksFor(int64(len(contents))) {
+		t.Fatal("blocks freed before the last handle was closed")
+	}
+
+	// They are freed once the last handle is closed
+	second.Close()
+	if fSys.numberFreeNodes != free {
+		t.Errorf("%d free blocks after the last close, want %d", fSys.numberFreeNodes, free)
+	}
+	checkBlocks(t, fSys)
+}
+
+func TestHandles_Stat(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	first := fs.Open("test")
+	second := fs.Open("test")
+
+	handles := fs.Stat("test").Handles()
+	if len(handles) != 2 {
+		t.Fatalf("%d handles, want 2", len(handles))
+	} else if handles[0] != first || handles[1] != second {
+		t.Error("handles are not the ones opened")
+	}
+
+	first.Close()
+	if handles = fs.Stat("test").Handles(); len(handles) != 1 || handles[0] != second {
+		t.Errorf("%d handles after closing one", len(handles))
+	}
+
+	second.Close()
+	if handles = fs.Stat("test").Handles(); len(handles) != 0 {
+		t.Errorf("%d handles after closing both", len(handles))
+	}
+}
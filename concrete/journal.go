@@ -0,0 +1,107 @@
+package concrete
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+// The states the journal can be in
+const (
+	// Shut down cleanly, the free list and reference counts can be
+	// trusted
+	_JournalClean = int64(iota)
+
+	// Opened for writing and not shut down since
+	_JournalDirty
+
+	// Opened for writing and a name table follows which may not have
+	// reached the name file yet
+	_JournalPending
+)
+
+var _JournalSignature = []byte("GOFSJRNL")
+
+const (
+	_JournalStateSize    = 8
+	_JournalLengthSize   = 8
+	_JournalChecksumSize = 4
+
+	_JournalHeaderSize = _SignatureSize + _JournalStateSize + _JournalLengthSize + _JournalChecksumSize
+)
+
+// Converts the journal header for a name table to bytes
+func encodeJournal(state int64, names []byte) []byte {
+	var buffer bytes.Buffer
+	buffer.Write(_JournalSignature)
+	binary.Write(&buffer, binary.BigEndian, state)
+	binary.Write(&buffer, binary.BigEndian, int64(len(names)))
+	binary.Write(&buffer, binary.BigEndian, crc32.ChecksumIEEE(names))
+	buffer.Write(names)
+	return buffer.Bytes()
+}
+
+// Reads the state of the journal.  The name table is returned if one
+// is pending and it was written completely.  An empty journal, as
+// left by versions without one, was shut down cleanly.
+func (fSys *fileSystemImpl) readJournal() (state int64, names []byte, err error) {
+	if fSys.journal == nil || fSys.journal.Size() == 0 {
+		return _JournalClean, nil, nil
+	}
+
+	header := make([]byte, _JournalHeaderSize)
+	if err = readAt(fSys.journal, header, 0); err != nil {
+		return
+	} else if !bytes.Equal(header[:_SignatureSize], _JournalSignature) {
+		return 0, nil, fmt.Errorf("journal signature mismatch: %x", header[:_SignatureSize])
+	}
+
+	state = int64(binary.BigEndian.Uint64(header[_SignatureSize:]))
+	length := int64(binary.BigEndian.Uint64(header[_SignatureSize+_JournalStateSize:]))
+	checksum := binary.BigEndian.Uint32(header[_JournalHeaderSize-_JournalChecksumSize:])
+
+	if state < _JournalClean || state > _JournalPending {
+		return 0, nil, fmt.Errorf("invalid journal state: %d", state)
+	} else if state != _JournalPending {
+		return state, nil, nil
+	}
+
+	// A torn name table never reached the name file, which still
+	// holds the one before it
+	if length < _HeaderSize || length > fSys.journal.Size()-_JournalHeaderSize {
+		return state, nil, nil
+	}
+
+	names = make([]byte, length)
+	if err = readAt(fSys.journal, names, _JournalHeaderSize); err != nil {
+		return
+	} else if crc32.ChecksumIEEE(names) != checksum {
+		names = nil
+	}
+	return state, names, nil
+}
+
+// Sets the state of the journal and waits for it to reach the disk
+func (fSys *fileSystemImpl) markJournal(state int64) error {
+	if err := writeAt(fSys.journal, encodeJournal(state, nil), 0); err != nil {
+		return err
+	}
+	return fSys.journal.Sync()
+}
+
+// Writes the name table so that a crash leaves either the old or the
+// new one.  The blocks it points at are synced first, then the table
+// is written to the journal and only then to the name file.
+func (fSys *fileSystemImpl) commitNames(names []byte) error {
+	if err := fSys.dataFile.Sync(); err != nil {
+		return err
+	} else if err = writeAt(fSys.journal, encodeJournal(_JournalPending, names), 0); err != nil {
+		return err
+	} else if err = fSys.journal.Sync(); err != nil {
+		return err
+	} else if err = writeAt(fSys.nameFile, names, 0); err != nil {
+		return err
+	}
+	return fSys.nameFile.Sync()
+}
@@ -0,0 +1,110 @@
+package concrete
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deathly809/gofs"
+)
+
+// Reads every file in the directory
+func readDir(t *testing.T, dir string) map[string][]byte {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := make(map[string][]byte)
+	for _, entry := range entries {
+		if result[entry.Name()], err = os.ReadFile(filepath.Join(dir, entry.Name())); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := Open(dir, "readonly")
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "test", "contents")
+	if err = fs.Snapshot("snap"); err != nil {
+		t.Fatal(err)
+	} else if err = fs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	before := readDir(t, dir)
+	if fs, err = Open(dir, "readonly", ReadOnly()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Everything can be read
+	if got := readFile(t, fs, "test"); got != "contents" {
+		t.Errorf("test is %q", got)
+	}
+	view, err := fs.OpenSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	} else if got := readFile(t, view, "test"); got != "contents" {
+		t.Errorf("test is %q in the snapshot", got)
+	}
+	view.Shutdown(context.Background())
+
+	// Nothing can be changed
+	file := fs.Open("test")
+	if _, err = file.Write([]byte("x")); err != gofs.ErrReadOnly {
+		t.Errorf("write returned %v", err)
+	}
+	file.Close()
+
+	if fs.Open("new") != nil {
+		t.Error("created a file")
+	} else if err = fs.Delete("test"); err != gofs.ErrReadOnly {
+		t.Errorf("delete returned %v", err)
+	} else if err = fs.Clone("test", "clone"); err != gofs.ErrReadOnly {
+		t.Errorf("clone returned %v", err)
+	} else if err = fs.Snapshot("other"); err != gofs.ErrReadOnly {
+		t.Errorf("snapshot returned %v", err)
+	} else if err = fs.DeleteSnapshot("snap"); err != gofs.ErrReadOnly {
+		t.Errorf("delete snapshot returned %v", err)
+	} else if _, err = fs.Begin(); err != gofs.ErrReadOnly {
+		t.Errorf("begin returned %v", err)
+	} else if err = fs.Compact(nil); err != gofs.ErrReadOnly {
+		t.Errorf("compact returned %v", err)
+	} else if err = fs.(gofs.TimeSetter).SetLastModified("test", time.Now()); err != gofs.ErrReadOnly {
+		t.Errorf("set last modified returned %v", err)
+	}
+
+	if err = fs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	after := readDir(t, dir)
+	for name, data := range before {
+		if !bytes.Equal(data, after[name]) {
+			t.Errorf("%s was changed", name)
+		}
+	}
+	if len(after) != len(before) {
+		t.Errorf("%d files after opening read-only, want %d", len(after), len(before))
+	}
+}
+
+func TestReadOnly_Missing(t *testing.T) {
+	dir := t.TempDir()
+	if fs, err := Open(dir, "missing", ReadOnly()); err == nil {
+		fs.Shutdown(context.Background())
+		t.Error("opened a missing file system read-only")
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("read-only open created %d files", len(entries))
+	}
+}
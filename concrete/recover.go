@@ -0,0 +1,143 @@
+package concrete
+
+import "encoding/binary"
+
+// Returns every file entry in the name table: the files, the files
+// of the snapshots and the versions of files
+func (fSys *fileSystemImpl) entries() []*fileInfo {
+	var result []*fileInfo
+	for _, name := range sortedNames(fSys.files) {
+		result = append(result, fSys.files[name])
+	}
+	for _, snap := range fSys.sortedSnapshots() {
+		for _, name := range sortedNames(snap.files) {
+			result = append(result, snap.files[name])
+		}
+	}
+	for _, name := range sortedVersionNames(fSys.versions) {
+		for _, v := range fSys.versions[name].versions {
+			result = append(result, v.info)
+		}
+	}
+	return result
+}
+
+// Rebuilds the free list and the reference counts from the blocks
+// reachable from the name table.  Used when the file system was not
+// shut down cleanly, as blocks taken from or given back to the free
+// list since the name table was last written are not accounted for.
+//
+// Each chain is walked for as many blocks as its size needs and cut
+// there, so blocks appended after the table was written are freed.
+// A chain which is broken off early is truncated to the blocks which
+// could be read.
+func (fSys *fileSystemImpl) recover() error {
+	if size := fSys.dataFile.Size() / _BlockSize * _BlockSize; size < fSys.sizeInBytes {
+		fSys.sizeInBytes = size
+	}
+
+	total := fSys.sizeInBytes / _BlockSize
+	used := make(map[int64]bool)
+	incoming := make(map[int64]int64)
+	continued := make(map[int64]bool)
+	tails := make(map[int64]bool)
+
+	for _, info := range fSys.entries() {
+		var count int64
+		last := int64(_NullIndex)
+		seen := make(map[int64]bool)
+
+		for curr := info.first; count < blocksFor(info.size); count++ {
+			if curr < 0 || curr >= total || seen[curr] {
+				break
+			}
+
+			node, err := fSys.getBlock(curr)
+			if err != nil {
+				return err
+			}
+
+			if last != _NullIndex {
+				continued[last] = true
+			}
+			seen[curr] = true
+			last, curr = curr, node.next
+		}
+
+		if count < blocksFor(info.size) {
+			info.size = count * _DataSize
+		}
+		if count == 0 {
+			info.first = _NullIndex
+		}
+		info.last = last
+		info.owned = 0
+
+		if info.first != _NullIndex {
+			incoming[info.first]++
+			tails[last] = true
+		}
+
+		for index := range seen {
+			used[index] = true
+		}
+	}
+
+	// Count the links between the blocks in use and end every chain
+	// at its last block
+	for index := range used {
+		node, err := fSys.getBlock(index)
+		if err != nil {
+			return err
+		}
+
+		if continued[index] {
+			incoming[node.next]++
+		} else if tails[index] && node.next != _NullIndex {
+			node.next = _NullIndex
+			if err = fSys.writeNode(node); err != nil {
+				return err
+			}
+		}
+	}
+
+	fSys.refs = make(map[int64]int64)
+	for index, count := range incoming {
+		if count > 1 {
+			fSys.refs[index] = count
+		}
+	}
+
+	// Everything else is free, linked in order
+	var free []int64
+	for index := int64(0); index < total; index++ {
+		if !used[index] {
+			free = append(free, index)
+		}
+	}
+
+	header := make([]byte, 2*_PointerSize)
+	for i, index := range free {
+		prev, next := int64(_NullIndex), int64(_NullIndex)
+		if i > 0 {
+			prev = free[i-1]
+		}
+		if i < len(free)-1 {
+			next = free[i+1]
+		}
+
+		binary.BigEndian.PutUint64(header, uint64(prev))
+		binary.BigEndian.PutUint64(header[_PointerSize:], uint64(next))
+		if err := writeAt(fSys.dataFile, header, index*_BlockSize); err != nil {
+			return err
+		}
+	}
+
+	fSys.indexOfFirstFree = _NullIndex
+	if len(free) > 0 {
+		fSys.indexOfFirstFree = free[0]
+	}
+	fSys.numberFreeNodes = int64(len(free))
+
+	return fSys.writeNames()
+}
@@ -0,0 +1,132 @@
+package concrete
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/device"
+)
+
+func TestSafe_NoMix(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	size := 3 * _DataSize
+	writeFile(t, fs, "test", string(bytes.Repeat([]byte{0}, size)))
+
+	writer := fs.Open("test")
+	reader := fs.Open("test")
+	safeWriter := fs.GetSafeWriter(writer)
+	safeReader := fs.GetSafeReader(reader)
+	defer writer.Close()
+	defer reader.Close()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 50; i++ {
+			writer.Seek(0, int(gofs.Beginning))
+			safeWriter.Write(bytes.Repeat([]byte{byte(i)}, size))
+		}
+	}()
+
+	// Every read sees a single write, whole
+	data := make([]byte, size)
+	for i := 0; i < 50; i++ {
+		reader.Seek(0, int(gofs.Beginning))
+		if _, err := io.ReadFull(safeReader, data); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(data, bytes.Repeat(data[:1], size)) {
+			t.Fatal("read a mix of two writes")
+		}
+	}
+	wg.Wait()
+}
+
+func TestSafe_PartialWrite(t *testing.T) {
+	disk := device.NewFaultyDisk()
+	fs, err := Open("", "safe", Storage(disk.Open))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	file := fs.Open("test")
+	other := fs.Open("test")
+	old := bytes.Repeat([]byte("old "), _DataSize)
+	file.Write(old)
+	file.Seek(0, int(gofs.Beginning))
+
+	// Fail the write of the data of the second block.  Each block is
+	// copied in three writes and its data written in one more, the
+	// copy of the second is also linked to the first.
+	data := bytes.Repeat([]byte("new "), _DataSize)
+	disk.Inject(device.FailAt(device.OpWrite, disk.Count(device.OpWrite)+9, errInjected))
+
+	writer := fs.GetSafeWriter(file)
+	if n, err := writer.Write(data); n != 0 || err != errInjected {
+		t.Fatalf("write returned %d, %v", n, err)
+	}
+
+	// None of the write is in the file
+	if pos, _ := file.Seek(0, int(gofs.Current)); pos != 0 {
+		t.Errorf("position is %d after a failed write", pos)
+	} else if got := readAll(t, other); got != string(old) {
+		t.Error("a failed write changed the file")
+	}
+
+	// All of the next is, through every handle
+	file.Seek(0, int(gofs.Beginning))
+	if n, err := writer.Write(data); n != len(data) || err != nil {
+		t.Fatalf("write returned %d, %v", n, err)
+	} else if got := readAll(t, other); got != string(data) {
+		t.Error("the bytes written differ")
+	}
+
+	file.Close()
+	other.Close()
+	checkBlocks(t, fSys)
+}
+
+func TestSafe_Guards(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	first := fs.Open("test")
+	second := fs.Open("test")
+	fs.GetSafeReader(first)
+	fs.GetSafeWriter(second)
+	if fSys.state.Guards() != 1 {
+		t.Fatalf("%d guards for one file", fSys.state.Guards())
+	}
+
+	// Kept until the last handle is closed
+	first.Close()
+	if fSys.state.Guards() != 1 {
+		t.Error("guard dropped while a handle is open")
+	}
+	second.Close()
+	if fSys.state.Guards() != 0 {
+		t.Error("guard kept after the last handle was closed")
+	}
+
+	// A deleted file keeps the guard until its last handle is closed
+	file := fs.Open("test")
+	fs.GetSafeReader(file)
+	if err := fs.Delete("test"); err != nil {
+		t.Fatal(err)
+	} else if fSys.state.Guards() != 1 {
+		t.Error("guard dropped while a deleted file is open")
+	}
+	file.Close()
+	if fSys.state.Guards() != 0 {
+		t.Error("guard kept after the deleted file was closed")
+	}
+}
@@ -0,0 +1,110 @@
+package concrete
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/deathly809/gofs"
+)
+
+func TestShutdown_Drains(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := Open(dir, "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, fs, "test", "contents")
+	file := fs.Open("test")
+	fs.Lock(file)
+
+	done := make(chan error)
+	go func() {
+		done <- fs.Shutdown(context.Background())
+	}()
+
+	// Waits for the lock to be released
+	select {
+	case err = <-done:
+		t.Fatalf("shut down while a file was locked: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if fs.Open("other") != nil {
+		t.Error("opened a file while shutting down")
+	}
+
+	// Handles still work until the lock is released
+	if got := readAll(t, file); got != "contents" {
+		t.Errorf("read %q while shutting down", got)
+	}
+	fs.Unlock(file)
+
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	checkClosed(t, fs, file)
+
+	// Everything was saved
+	if fs, err = Open(dir, "shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	if got := readFile(t, fs, "test"); got != "contents" {
+		t.Errorf("test is %q after opening again", got)
+	}
+}
+
+func TestShutdown_Deadline(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := Open(dir, "shutdown")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	writeFile(t, fs, "test", "contents")
+	file := fs.Open("test")
+	fs.Lock(file)
+
+	// The lock is never released
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+
+	if err = fs.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown returned %v", err)
+	}
+	checkClosed(t, fs, file)
+
+	if fs, err = Open(dir, "shutdown"); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	if got := readFile(t, fs, "test"); got != "contents" {
+		t.Errorf("test is %q after opening again", got)
+	}
+}
+
+// Checks that every call made after the file system was shut down
+// fails
+func checkClosed(t *testing.T, fs FileSystem, file gofs.File) {
+	t.Helper()
+
+	if err := fs.Shutdown(context.Background()); err != gofs.ErrClosed {
+		t.Errorf("shut down twice: %v", err)
+	} else if fs.Open("test") != nil {
+		t.Error("opened a file")
+	} else if err = fs.Delete("test"); err != gofs.ErrClosed {
+		t.Errorf("delete returned %v", err)
+	} else if err = fs.Snapshot("snap"); err != gofs.ErrClosed {
+		t.Errorf("snapshot returned %v", err)
+	} else if _, err = fs.Begin(); err != gofs.ErrClosed {
+		t.Errorf("begin returned %v", err)
+	} else if _, err = file.Write([]byte("more")); err == nil {
+		t.Error("wrote through a handle")
+	} else if _, err = file.Read(make([]byte, 1)); err == nil {
+		t.Error("read through a handle")
+	}
+}
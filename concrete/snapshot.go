@@ -0,0 +1,155 @@
+package concrete
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
+)
+
+// A point-in-time copy of the name table.  The blocks of the files
+// are shared with the file system until either side changes them.
+type snapshot struct {
+	name    string
+	created time.Time
+	files   map[string]*fileInfo
+}
+
+// SnapshotInfo describes a snapshot of the file system
+type SnapshotInfo struct {
+	Name    string    // name given when the snapshot was taken
+	Created time.Time // when the snapshot was taken
+	Files   int       // number of files in the snapshot
+}
+
+// Returns the snapshots from oldest to newest
+func (fSys *fileSystemImpl) sortedSnapshots() []*snapshot {
+	result := make([]*snapshot, 0, len(fSys.snapshots))
+	for _, snap := range fSys.snapshots {
+		result = append(result, snap)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].created.Equal(result[j].created) {
+			return result[i].name < result[j].name
+		}
+		return result[i].created.Before(result[j].created)
+	})
+	return result
+}
+
+// Checks the file system may be changed, must be called with the
+// lock held
+func (fSys *fileSystemImpl) checkWritable() error {
+	if fSys.state.Status != fsutil.Open {
+		return gofs.ErrClosed
+	} else if fSys.readOnly {
+		return gofs.ErrReadOnly
+	}
+	return nil
+}
+
+func (fSys *fileSystemImpl) Snapshot(name string) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	} else if len(name) == 0 || len(name) > _NameSize {
+		return fmt.Errorf("invalid snapshot name: %q", name)
+	} else if _, exists := fSys.snapshots[name]; exists {
+		return fmt.Errorf("snapshot already exists: %s", name)
+	}
+
+	snap := &snapshot{
+		name:    name,
+		created: time.Now(),
+		files:   make(map[string]*fileInfo),
+	}
+
+	// Sharing the first block of each file shares the whole chain,
+	// writes copy blocks as they reach them
+	for filename, info := range fSys.files {
+		snap.files[filename] = info.clone()
+		fSys.incRef(info.first)
+		info.owned = 0
+	}
+
+	fSys.snapshots[name] = snap
+	return fSys.writeNames()
+}
+
+func (fSys *fileSystemImpl) Snapshots() []SnapshotInfo {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	result := make([]SnapshotInfo, 0, len(fSys.snapshots))
+	for _, snap := range fSys.sortedSnapshots() {
+		result = append(result, SnapshotInfo{
+			Name:    snap.name,
+			Created: snap.created,
+			Files:   len(snap.files),
+		})
+	}
+	return result
+}
+
+func (fSys *fileSystemImpl) OpenSnapshot(name string) (gofs.FileSystem, error) {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status != fsutil.Open {
+		return nil, gofs.ErrClosed
+	}
+
+	snap, exists := fSys.snapshots[name]
+	if !exists {
+		return nil, fmt.Errorf("snapshot does not exist: %s", name)
+	}
+
+	// The view shares the data file and the lock guarding it
+	view := newFileSystem()
+	view.lock = fSys.lock
+	view.state = fsutil.NewState(fSys.lock)
+	view.parent = fSys
+	view.readOnly = true
+	view.dataFile = fSys.dataFile
+
+	for filename, info := range snap.files {
+		view.files[filename] = info.clone()
+	}
+
+	fSys.views[view] = name
+	return view, nil
+}
+
+func (fSys *fileSystemImpl) DeleteSnapshot(name string) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	}
+
+	snap, exists := fSys.snapshots[name]
+	if !exists {
+		return fmt.Errorf("snapshot does not exist: %s", name)
+	}
+
+	for _, viewName := range fSys.views {
+		if viewName == name {
+			return fmt.Errorf("snapshot is open: %s", name)
+		}
+	}
+
+	for _, info := range snap.files {
+		if err := fSys.freeBlocks(info.first); err != nil {
+			return err
+		}
+	}
+
+	delete(fSys.snapshots, name)
+	return fSys.writeNames()
+}
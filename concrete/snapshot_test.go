@@ -0,0 +1,141 @@
+package concrete
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/deathly809/gofs"
+)
+
+func TestSnapshot_Isolation(t *testing.T) {
+	dir := t.TempDir()
+	fs, err := Open(dir, "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := strings.Repeat("a", 2*_DataSize)
+	writeFile(t, fs, "a", a)
+	writeFile(t, fs, "b", "b")
+	if err = fs.Snapshot("snap"); err != nil {
+		t.Fatal(err)
+	} else if err = fs.Snapshot("snap"); err == nil {
+		t.Error("took two snapshots with the same name")
+	}
+
+	// Changes after the snapshot are not seen in it
+	file := fs.Open("a")
+	file.Seek(_DataSize, int(gofs.Beginning))
+	file.Write([]byte("changed"))
+	file.Close()
+	fs.Delete("b")
+	writeFile(t, fs, "c", "c")
+
+	snaps := fs.Snapshots()
+	if len(snaps) != 1 || snaps[0].Name != "snap" || snaps[0].Files != 2 {
+		t.Fatalf("snapshots are %+v", snaps)
+	}
+
+	view, err := fs.OpenSnapshot("snap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, view, a)
+	if got := readFile(t, fs, "a"); got == a {
+		t.Error("change to a was lost")
+	} else if fs.Exists("b") || !fs.Exists("c") {
+		t.Error("file system has the files of the snapshot")
+	}
+
+	// The snapshot cannot be changed
+	if err = view.Delete("a"); err != gofs.ErrReadOnly {
+		t.Errorf("deleted from a snapshot: %v", err)
+	} else if file = view.Open("a"); file == nil {
+		t.Fatal("could not open a in the snapshot")
+	} else if _, err = file.Write([]byte("x")); err != gofs.ErrReadOnly {
+		t.Errorf("wrote to a snapshot: %v", err)
+	}
+	file.Close()
+	view.Shutdown(context.Background())
+
+	// Snapshots are kept in the name table
+	if err = fs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	} else if fs, err = Open(dir, "snapshot"); err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	if view, err = fs.OpenSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	}
+	defer view.Shutdown(context.Background())
+	checkSnapshot(t, view, a)
+	checkBlocks(t, fs.(*fileSystemImpl))
+}
+
+// Checks the view holds the files as they were when the snapshot was
+// taken
+func checkSnapshot(t *testing.T, view gofs.FileSystem, a string) {
+	t.Helper()
+
+	if got := readFile(t, view, "a"); got != a {
+		t.Error("a differs in the snapshot")
+	} else if got = readFile(t, view, "b"); got != "b" {
+		t.Errorf("b is %q in the snapshot", got)
+	} else if view.Exists("c") {
+		t.Error("c exists in the snapshot")
+	}
+}
+
+func TestSnapshot_Delete(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	writeFile(t, fs, "a", strings.Repeat("a", 3*_DataSize))
+	fs.Snapshot("snap")
+
+	// The snapshot keeps the blocks of a deleted file
+	fs.Delete("a")
+	free := fSys.numberFreeNodes
+
+	view, _ := fs.OpenSnapshot("snap")
+	if err := fs.DeleteSnapshot("snap"); err == nil {
+		t.Error("deleted a snapshot which is open")
+	}
+	view.Shutdown(context.Background())
+
+	if err := fs.DeleteSnapshot("snap"); err != nil {
+		t.Fatal(err)
+	} else if fSys.numberFreeNodes != free+3 {
+		t.Errorf("%d free blocks after deleting the snapshot, want %d", fSys.numberFreeNodes, free+3)
+	} else if _, err = fs.OpenSnapshot("snap"); err == nil {
+		t.Error("opened a deleted snapshot")
+	} else if err = fs.DeleteSnapshot("snap"); err == nil {
+		t.Error("deleted a snapshot twice")
+	}
+	checkBlocks(t, fSys)
+}
+
+func TestSnapshot_OutlivesGrowth(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	a := strings.Repeat("a", 2*_DataSize)
+	writeFile(t, fs, "a", a)
+	writeFile(t, fs, "b", "b")
+	fs.Snapshot("snap")
+	view, _ := fs.OpenSnapshot("snap")
+	defer view.Shutdown(context.Background())
+
+	// The view is opened before the data file grows and is compacted,
+	// which moves the blocks it reads past the size it was opened with
+	writeFile(t, fs, "big", strings.Repeat("big", 20*_DataSize))
+	fs.Delete("a")
+	if err := fs.Compact(nil); err != nil {
+		t.Fatal(err)
+	}
+	checkSnapshot(t, view, a)
+}
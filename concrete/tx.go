@@ -0,0 +1,299 @@
+package concrete
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
+)
+
+// ErrTxDone is returned by any call to a transaction which has
+// already been committed or rolled back
+var ErrTxDone = errors.New("concrete: transaction has already been committed or rolled back")
+
+// Tx is a set of changes to several files which are made visible
+// all at once, or not at all
+type Tx interface {
+	//	Open returns a handle to the file as seen by the transaction.
+	//	If the file does not exist it is created with 0 length.
+	//	Writes through the handle go to new blocks and are only seen
+	//	by others once the transaction is committed.
+	//
+	//	If an error occurs nil is returned
+	//
+	Open(string) gofs.File
+
+	//	Delete removes the file when the transaction is committed
+	Delete(string) error
+
+	//	Rename moves the file to a new name when the transaction is
+	//	committed, replacing any file with that name
+	Rename(oldName, newName string) error
+
+	//	Commit replaces the name table entries of every file changed
+	//	by the transaction at once.  The latest change to a file wins
+	//	if it was also changed outside of the transaction.
+	Commit() error
+
+	//	Rollback discards the changes made by the transaction
+	Rollback() error
+}
+
+// The changes a transaction has made
+type transaction struct {
+	fs      *fileSystemImpl
+	files   map[string]*fileInfo // the files seen by the transaction, nil if deleted
+	changed map[*fileInfo]bool   // the files written, created or renamed
+	done    bool
+}
+
+func (fSys *fileSystemImpl) Begin() (Tx, error) {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return nil, err
+	}
+
+	result := &transaction{
+		fs:      fSys,
+		files:   make(map[string]*fileInfo),
+		changed: make(map[*fileInfo]bool),
+	}
+	fSys.transactions[result] = true
+
+	return result, nil
+}
+
+// Checks the transaction may still be used, must be called with the
+// lock held
+func (t *transaction) check() error {
+	if t.done {
+		return ErrTxDone
+	} else if t.fs.state.Status != fsutil.Open {
+		return gofs.ErrClosed
+	}
+	return nil
+}
+
+// Returns the transaction's copy of a file, copying the file from the
+// file system on first use.  The copy shares the blocks of the file.
+func (t *transaction) lookup(filename string) (*fileInfo, bool) {
+	if info, exists := t.files[filename]; exists {
+		return info, info != nil
+	}
+
+	info, exists := t.fs.files[filename]
+	if !exists {
+		return nil, false
+	}
+
+	result := info.clone()
+	t.fs.incRef(info.first)
+	info.owned = 0
+
+	t.files[filename] = result
+	return result, true
+}
+
+func (t *transaction) Open(filename string) gofs.File {
+	if len(filename) == 0 || len(filename) > _NameSize {
+		return nil
+	}
+
+	t.fs.lock.Lock()
+	defer t.fs.lock.Unlock()
+
+	if t.check() != nil {
+		return nil
+	}
+
+	info, exists := t.lookup(filename)
+	if !exists {
+		now := time.Now()
+		info = &fileInfo{
+			name:         filename,
+			first:        _NullIndex,
+			last:         _NullIndex,
+			created:      now,
+			lastModified: now,
+		}
+		t.files[filename] = info
+		t.changed[info] = true
+	}
+
+	handle := &file{
+		fs:     t.fs,
+		curr:   fileNode{id: _NullIndex},
+		fInfo:  info,
+		isnew:  !exists,
+		status: fsutil.Open,
+		tx:     t,
+	}
+	t.fs.openFiles[info] = append(t.fs.openFiles[info], handle)
+
+	return handle
+}
+
+func (t *transaction) Delete(filename string) error {
+	t.fs.lock.Lock()
+	defer t.fs.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	if info, exists := t.lookup(filename); exists {
+		t.files[filename] = nil
+		delete(t.changed, info)
+		return t.fs.release(info)
+	}
+	return nil
+}
+
+func (t *transaction) Rename(oldName, newName string) error {
+	t.fs.lock.Lock()
+	defer t.fs.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	} else if len(newName) == 0 || len(newName) > _NameSize {
+		return fmt.Errorf("invalid file name: %q", newName)
+	} else if oldName == newName {
+		return nil
+	}
+
+	info, exists := t.lookup(oldName)
+	if !exists {
+		return fmt.Errorf("file does not exist: %s", oldName)
+	}
+
+	if replaced, exists := t.lookup(newName); exists {
+		delete(t.changed, replaced)
+		if err := t.fs.release(replaced); err != nil {
+			return err
+		}
+	}
+
+	info.name = newName
+	t.files[oldName] = nil
+	t.files[newName] = info
+	t.changed[info] = true
+
+	return nil
+}
+
+func (t *transaction) Commit() error {
+	fSys := t.fs
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := t.check(); err != nil {
+		return err
+	}
+
+	// The new name table is built aside and swapped in at once, the
+	// blocks of the entries it replaces are only released after
+	files := make(map[string]*fileInfo, len(fSys.files))
+	for filename, info := range fSys.files {
+		files[filename] = info
+	}
+
+	var released, committed []*fileInfo
+	var removed []string
+	for filename, info := range t.files {
+		if info != nil && !t.changed[info] {
+			// Only opened, the file system's copy is kept and the
+			// handles are moved over to it
+			if live, exists := fSys.files[filename]; exists {
+				fSys.moveHandles(info, live)
+			}
+			released = append(released, info)
+			continue
+		}
+
+		if live, exists := files[filename]; exists {
+			delete(files, filename)
+			released = append(released, live)
+		}
+
+		if info == nil {
+			removed = append(removed, filename)
+		} else {
+			files[filename] = info
+			committed = append(committed, info)
+		}
+	}
+
+	fSys.files = files
+	for _, filename := range removed {
+		if hist, exists := fSys.versions[filename]; exists {
+			for _, v := range hist.versions {
+				released = append(released, v.info)
+			}
+			delete(fSys.versions, filename)
+		}
+	}
+	if fSys.versioned {
+		for _, info := range committed {
+			fSys.recordVersion(info)
+		}
+	}
+	t.finish()
+
+	// The transaction is committed whatever happens now, blocks which
+	// could not be released are found again by recovery
+	var err error
+	for _, info := range released {
+		if e := fSys.release(info); err == nil {
+			err = e
+		}
+	}
+	if e := fSys.writeNames(); err == nil {
+		err = e
+	}
+	return err
+}
+
+func (t *transaction) Rollback() error {
+	t.fs.lock.Lock()
+	defer t.fs.lock.Unlock()
+
+	if t.done {
+		return ErrTxDone
+	}
+	return t.rollback()
+}
+
+// Releases the copies of files made by the transaction, must be
+// called with the lock held
+func (t *transaction) rollback() error {
+	t.finish()
+
+	for _, info := range t.files {
+		if info != nil {
+			if err := t.fs.release(info); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Marks the transaction as done, handles opened in it now belong to
+// the file system.  Their changes so far were already saved, or
+// thrown away, with the transaction.
+func (t *transaction) finish() {
+	t.done = true
+	delete(t.fs.transactions, t)
+
+	for _, info := range t.files {
+		for _, handle := range t.fs.openFiles[info] {
+			handle.tx = nil
+			handle.modified = false
+		}
+	}
+}
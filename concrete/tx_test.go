@@ -0,0 +1,278 @@
+package concrete
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/device"
+)
+
+// Writes the contents to a file opened in the transaction
+func txWrite(t *testing.T, tx Tx, name, contents string) {
+	t.Helper()
+
+	file := tx.Open(name)
+	if file == nil {
+		t.Fatalf("could not open %s", name)
+	} else if _, err := file.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	} else if err = file.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTx_Commit(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeFile(t, fs, "a", "old a")
+
+	tx, err := fs.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txWrite(t, tx, "a", "new a")
+	txWrite(t, tx, "b", "new b")
+
+	// Nothing is seen before the commit
+	if got := readFile(t, fs, "a"); got != "old a" {
+		t.Errorf("a is %q before the commit", got)
+	} else if fs.Exists("b") {
+		t.Error("b exists before the commit")
+	}
+
+	if err = tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "a"); got != "new a" {
+		t.Errorf("a is %q after the commit", got)
+	} else if got = readFile(t, fs, "b"); got != "new b" {
+		t.Errorf("b is %q after the commit", got)
+	}
+
+	if err = tx.Commit(); err != ErrTxDone {
+		t.Errorf("committed twice: %v", err)
+	} else if err = tx.Rollback(); err != ErrTxDone {
+		t.Errorf("rolled back after committing: %v", err)
+	} else if tx.Open("c") != nil {
+		t.Error("opened a file after committing")
+	}
+}
+
+func TestTx_Rollback(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeFile(t, fs, "a", "old")
+	free := fs.(*fileSystemImpl).numberFreeNodes
+
+	tx, _ := fs.Begin()
+	txWrite(t, tx, "a", "new")
+	txWrite(t, tx, "b", "new")
+	if err := tx.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, fs, "a"); got != "old" {
+		t.Errorf("a is %q after rolling back", got)
+	} else if fs.Exists("b") {
+		t.Error("b exists after rolling back")
+	}
+
+	// The blocks the transaction wrote are free again
+	fs.(*fileSystemImpl).writeNames()
+	if got := fs.(*fileSystemImpl).numberFreeNodes; got != free {
+		t.Errorf("%d free blocks after rolling back, want %d", got, free)
+	}
+
+	if err := tx.Commit(); err != ErrTxDone {
+		t.Errorf("committed after rolling back: %v", err)
+	}
+}
+
+func TestTx_DeleteAndRename(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeFile(t, fs, "a", "a")
+	writeFile(t, fs, "b", "b")
+	writeFile(t, fs, "c", "c")
+
+	tx, _ := fs.Begin()
+	if err := tx.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	} else if err = tx.Delete("c"); err != nil {
+		t.Fatal(err)
+	} else if err = tx.Rename("missing", "d"); err == nil {
+		t.Error("renamed a file which does not exist")
+	} else if err = tx.Rename("b", ""); err == nil {
+		t.Error("renamed a file to an empty name")
+	}
+
+	// The transaction sees its own changes
+	if file := tx.Open("b"); file == nil {
+		t.Fatal("could not open b")
+	} else if got := readAll(t, file); got != "a" {
+		t.Errorf("b is %q in the transaction", got)
+	} else {
+		file.Close()
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if fs.Exists("a") || fs.Exists("c") {
+		t.Error("a or c exists after the commit")
+	} else if got := readFile(t, fs, "b"); got != "a" {
+		t.Errorf("b is %q after the commit", got)
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+}
+
+func TestRename(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeFile(t, fs, "a", "a")
+	writeFile(t, fs, "b", "b")
+
+	renamer := fs.(gofs.Renamer)
+	if err := renamer.Rename("a", "b"); err != nil {
+		t.Fatal(err)
+	} else if fs.Exists("a") {
+		t.Error("a exists after the rename")
+	} else if got := readFile(t, fs, "b"); got != "a" {
+		t.Errorf("b is %q after the rename", got)
+	}
+
+	// Nothing changes when the rename fails
+	if err := renamer.Rename("missing", "b"); err == nil {
+		t.Error("renamed a file which does not exist")
+	} else if got := readFile(t, fs, "b"); got != "a" {
+		t.Errorf("b is %q after a failed rename", got)
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+}
+
+func TestTx_Conflict(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeFile(t, fs, "a", "old")
+	writeFile(t, fs, "b", "old")
+
+	tx, _ := fs.Begin()
+	txWrite(t, tx, "a", "in the transaction")
+
+	// Changed outside of the transaction after it first saw the files
+	writeFile(t, fs, "a", "outside")
+	writeFile(t, fs, "b", "outside")
+	if file := tx.Open("b"); file == nil {
+		t.Fatal("could not open b")
+	} else if got := readAll(t, file); got != "outside" {
+		t.Errorf("transaction sees b as %q", got)
+	} else {
+		file.Close()
+	}
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The commit is the latest change to a, b was only read
+	if got := readFile(t, fs, "a"); got != "in the transaction" {
+		t.Errorf("a is %q after the commit", got)
+	} else if got = readFile(t, fs, "b"); got != "outside" {
+		t.Errorf("b is %q after the commit", got)
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+}
+
+func TestTx_HandlesOutliveCommit(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeFile(t, fs, "read", "read")
+
+	tx, _ := fs.Begin()
+	read := tx.Open("read")
+	written := tx.Open("written")
+	written.Write([]byte("written"))
+
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Writes after the commit go to the files in the file system
+	read.Seek(0, int(gofs.End))
+	if _, err := read.Write([]byte(" more")); err != nil {
+		t.Fatal(err)
+	} else if _, err = written.Write([]byte(" more")); err != nil {
+		t.Fatal(err)
+	}
+	read.Close()
+	written.Close()
+
+	if got := readFile(t, fs, "read"); got != "read more" {
+		t.Errorf("read is %q", got)
+	} else if got = readFile(t, fs, "written"); got != "written more" {
+		t.Errorf("written is %q", got)
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+}
+
+func TestTx_CommitFails(t *testing.T) {
+	ops := map[string]device.Op{"Read": device.OpRead, "Write": device.OpWrite, "Sync": device.OpSync}
+	for name, op := range ops {
+		t.Run(name, func(t *testing.T) {
+			disk := device.NewFaultyDisk()
+			fs, err := Open("", "tx", Storage(disk.Open))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			big := string(make([]byte, 2*_DataSize))
+			writeFile(t, fs, "a", "old"+big)
+			writeFile(t, fs, "b", "old"+big)
+			disk.PowerOff()
+			disk = disk.Crash(rand.New(rand.NewSource(0)), false)
+
+			if fs, err = Open("", "tx", Storage(disk.Open)); err != nil {
+				t.Fatal(err)
+			}
+
+			tx, _ := fs.Begin()
+			txWrite(t, tx, "a", "new"+big)
+			txWrite(t, tx, "b", "new"+big)
+
+			disk.Inject(device.FailAt(op, disk.Count(op)+1, errInjected))
+			if err = tx.Commit(); err != errInjected {
+				t.Fatalf("commit returned %v", err)
+			}
+
+			// The commit is all or nothing however far it got
+			a, b := readFile(t, fs, "a")[:3], readFile(t, fs, "b")[:3]
+			if a != "new" || b != "new" {
+				t.Errorf("a is %q and b is %q after a failed commit", a, b)
+			} else if err = tx.Commit(); err != ErrTxDone {
+				t.Errorf("committed twice: %v", err)
+			}
+
+			disk.PowerOff()
+			if fs, err = Open("", "tx", Storage(disk.Crash(rand.New(rand.NewSource(0)), true).Open)); err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Shutdown(context.Background())
+
+			checkBlocks(t, fs.(*fileSystemImpl))
+			if a, b = readFile(t, fs, "a")[:3], readFile(t, fs, "b")[:3]; a != b {
+				t.Errorf("a is %q and b is %q after a crash", a, b)
+			}
+		})
+	}
+}
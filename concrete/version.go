@@ -0,0 +1,213 @@
+package concrete
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
+)
+
+// A past state of a file.  The blocks are shared with the file, and
+// the other versions, until one of them changes.
+type version struct {
+	number   int64
+	recorded time.Time
+	info     *fileInfo
+}
+
+// The versions of a single file
+type history struct {
+	latest   int64 // number of the newest version ever recorded
+	versions []*version
+}
+
+// VersionInfo describes a recorded version of a file
+type VersionInfo struct {
+	Number   int64     // increases by one with each version of the file
+	Recorded time.Time // when the version was recorded
+	Size     int64     // size of the file in bytes
+}
+
+// Versioned records a new version of a file each time a handle which
+// modified it is closed.  Versions are kept until they are pruned or
+// the file is deleted.
+func Versioned() Option {
+	return func(fSys *fileSystemImpl) {
+		fSys.versioned = true
+	}
+}
+
+// Records the current state of the file as its newest version
+func (fSys *fileSystemImpl) recordVersion(info *fileInfo) {
+	hist, exists := fSys.versions[info.name]
+	if !exists {
+		hist = &history{}
+		fSys.versions[info.name] = hist
+	}
+
+	fSys.incRef(info.first)
+	info.owned = 0
+
+	hist.latest++
+	hist.versions = append(hist.versions, &version{
+		number:   hist.latest,
+		recorded: time.Now(),
+		info:     info.clone(),
+	})
+}
+
+// Releases every version of the file
+func (fSys *fileSystemImpl) releaseVersions(filename string) error {
+	hist, exists := fSys.versions[filename]
+	if !exists {
+		return nil
+	}
+
+	for _, v := range hist.versions {
+		if err := fSys.release(v.info); err != nil {
+			return err
+		}
+	}
+	delete(fSys.versions, filename)
+	return nil
+}
+
+// Finds a version of the file, must be called with the lock held
+func (fSys *fileSystemImpl) findVersion(filename string, number int64) (*version, error) {
+	if fSys.state.Status != fsutil.Open {
+		return nil, gofs.ErrClosed
+	}
+
+	if hist, exists := fSys.versions[filename]; exists {
+		for _, v := range hist.versions {
+			if v.number == number {
+				return v, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("version %d of %s does not exist", number, filename)
+}
+
+func (fSys *fileSystemImpl) Versions(filename string) []VersionInfo {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	var result []VersionInfo
+	if hist, exists := fSys.versions[filename]; exists {
+		result = make([]VersionInfo, 0, len(hist.versions))
+		for _, v := range hist.versions {
+			result = append(result, VersionInfo{
+				Number:   v.number,
+				Recorded: v.recorded,
+				Size:     v.info.size,
+			})
+		}
+	}
+	return result
+}
+
+func (fSys *fileSystemImpl) OpenVersion(filename string, number int64) (gofs.File, error) {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	v, err := fSys.findVersion(filename, number)
+	if err != nil {
+		return nil, err
+	}
+
+	handle := &file{
+		fs:       fSys,
+		curr:     fileNode{id: _NullIndex},
+		fInfo:    v.info,
+		status:   fsutil.Open,
+		readOnly: true,
+	}
+	fSys.openFiles[v.info] = append(fSys.openFiles[v.info], handle)
+
+	return handle, nil
+}
+
+func (fSys *fileSystemImpl) RestoreVersion(filename string, number int64) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	}
+
+	info, exists := fSys.files[filename]
+	if !exists {
+		return fmt.Errorf("file does not exist: %s", filename)
+	}
+
+	v, err := fSys.findVersion(filename, number)
+	if err != nil {
+		return err
+	}
+
+	if err = fSys.freeBlocks(info.first); err != nil {
+		return err
+	}
+
+	fSys.incRef(v.info.first)
+	info.first, info.last, info.size = v.info.first, v.info.last, v.info.size
+	info.lastModified = time.Now()
+	info.owned = 0
+	fSys.invalidate(info)
+
+	if fSys.versioned {
+		fSys.recordVersion(info)
+	}
+	return fSys.writeNames()
+}
+
+func (fSys *fileSystemImpl) PruneVersions(filename string, keep int) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	}
+
+	hist, exists := fSys.versions[filename]
+	if !exists || keep < 0 || len(hist.versions) <= keep {
+		return nil
+	}
+
+	pruned := hist.versions[:len(hist.versions)-keep]
+	hist.versions = hist.versions[len(hist.versions)-keep:]
+
+	for _, v := range pruned {
+		if err := fSys.release(v.info); err != nil {
+			return err
+		}
+	}
+	return fSys.writeNames()
+}
+
+func (fSys *fileSystemImpl) PruneVersionsBefore(filename string, before time.Time) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if err := fSys.checkWritable(); err != nil {
+		return err
+	}
+
+	hist, exists := fSys.versions[filename]
+	if !exists {
+		return nil
+	}
+
+	var kept []*version
+	for _, v := range hist.versions {
+		if !v.recorded.Before(before) {
+			kept = append(kept, v)
+		} else if err := fSys.release(v.info); err != nil {
+			return err
+		}
+	}
+
+	hist.versions = kept
+	return fSys.writeNames()
+}
@@ -0,0 +1,155 @@
+package concrete
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/deathly809/gofs"
+)
+
+// Returns the numbers of the versions of the file
+func versionNumbers(fs FileSystem, name string) []int64 {
+	var result []int64
+	for _, v := range fs.Versions(name) {
+		result = append(result, v.Number)
+	}
+	return result
+}
+
+// Reads a version of the file
+func readVersion(t *testing.T, fs FileSystem, name string, number int64) string {
+	t.Helper()
+
+	file, err := fs.OpenVersion(name, number)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	return readAll(t, file)
+}
+
+func TestVersions_Record(t *testing.T) {
+	fs := newFS(t, InMemory(), Versioned())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	for _, contents := range []string{"one", "two", "six"} {
+		writeAtOffset(t, fs, "test", 0, contents)
+	}
+
+	// Closing a handle which changed nothing records nothing
+	fs.Open("test").Close()
+
+	versions := fs.Versions("test")
+	if numbers := versionNumbers(fs, "test"); !reflect.DeepEqual(numbers, []int64{1, 2, 3}) {
+		t.Fatalf("versions are %v", numbers)
+	} else if versions[0].Size != 3 || versions[0].Recorded.After(versions[2].Recorded) {
+		t.Errorf("versions are %+v", versions)
+	}
+
+	for i, want := range []string{"one", "two", "six"} {
+		if got := readVersion(t, fs, "test", int64(i+1)); got != want {
+			t.Errorf("version %d is %q, want %q", i+1, got, want)
+		}
+	}
+
+	// Versions cannot be changed
+	file, _ := fs.OpenVersion("test", 1)
+	if _, err := file.Write([]byte("x")); err != gofs.ErrReadOnly {
+		t.Errorf("wrote to a version: %v", err)
+	}
+	file.Close()
+
+	if _, err := fs.OpenVersion("test", 4); err == nil {
+		t.Error("opened a version which does not exist")
+	}
+
+	// Deleting the file deletes its versions
+	fs.Delete("test")
+	if len(fs.Versions("test")) != 0 {
+		t.Error("versions kept after the file was deleted")
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+}
+
+func TestVersions_NotVersioned(t *testing.T) {
+	fs := newFS(t, InMemory())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeAtOffset(t, fs, "test", 0, "one")
+	writeAtOffset(t, fs, "test", 0, "two")
+	if len(fs.Versions("test")) != 0 {
+		t.Error("versions recorded without the option")
+	}
+}
+
+func TestVersions_Restore(t *testing.T) {
+	fs := newFS(t, InMemory(), Versioned())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+
+	writeAtOffset(t, fs, "test", 0, "one")
+	writeAtOffset(t, fs, "test", 0, "two and more")
+
+	if err := fs.RestoreVersion("test", 1); err != nil {
+		t.Fatal(err)
+	} else if got := readFile(t, fs, "test"); got != "one" {
+		t.Errorf("test is %q after restoring", got)
+	}
+
+	// The restore is itself a version
+	if numbers := versionNumbers(fs, "test"); !reflect.DeepEqual(numbers, []int64{1, 2, 3}) {
+		t.Errorf("versions are %v after restoring", numbers)
+	}
+
+	// Writes after the restore leave the version alone
+	writeAtOffset(t, fs, "test", 0, "new")
+	if got := readVersion(t, fs, "test", 1); got != "one" {
+		t.Errorf("version 1 is %q after writing", got)
+	}
+
+	if err := fs.RestoreVersion("test", 9); err == nil {
+		t.Error("restored a version which does not exist")
+	} else if err = fs.RestoreVersion("missing", 1); err == nil {
+		t.Error("restored a file which does not exist")
+	}
+	checkBlocks(t, fs.(*fileSystemImpl))
+}
+
+func TestVersions_Prune(t *testing.T) {
+	fs := newFS(t, InMemory(), Versioned())().(FileSystem)
+	defer fs.Shutdown(context.Background())
+	fSys := fs.(*fileSystemImpl)
+
+	for _, contents := range []string{"one", "two", "six", "ten"} {
+		writeAtOffset(t, fs, "test", 0, contents)
+	}
+
+	if err := fs.PruneVersions("test", 3); err != nil {
+		t.Fatal(err)
+	} else if numbers := versionNumbers(fs, "test"); !reflect.DeepEqual(numbers, []int64{2, 3, 4}) {
+		t.Errorf("versions are %v after keeping 3", numbers)
+	}
+	checkBlocks(t, fSys)
+
+	// By age
+	cut := time.Now()
+	time.Sleep(time.Millisecond)
+	writeAtOffset(t, fs, "test", 0, "new")
+
+	if err := fs.PruneVersionsBefore("test", cut); err != nil {
+		t.Fatal(err)
+	} else if numbers := versionNumbers(fs, "test"); !reflect.DeepEqual(numbers, []int64{5}) {
+		t.Errorf("versions are %v after pruning by age", numbers)
+	} else if got := readVersion(t, fs, "test", 5); got != "new" {
+		t.Errorf("version 5 is %q", got)
+	}
+	checkBlocks(t, fSys)
+
+	// Only the file itself is left
+	if err := fs.PruneVersions("test", 0); err != nil {
+		t.Fatal(err)
+	} else if usedBlocks(fSys) != 1 {
+		t.Errorf("%d blocks in use after pruning every version", usedBlocks(fSys))
+	}
+}
@@ -0,0 +1,38 @@
+// Package device contains the storage the concrete file system keeps
+// its name and data files on.
+//
+// A BlockDevice is a resizable run of bytes read and written at
+// offsets.  Devices are provided which memory map a file, which use
+// plain reads and writes on a file, and which only keep the bytes in
+// memory.
+package device
+
+import "io"
+
+// BlockDevice is storage read and written at offsets.  Writing past
+// the end grows the device.
+type BlockDevice interface {
+	io.ReaderAt
+	io.WriterAt
+
+	// Size returns the number of bytes stored
+	Size() int64
+
+	// Grow makes room for at least size bytes, the new bytes are
+	// zero.  Devices which are already large enough are unchanged.
+	Grow(size int64) error
+
+	// Truncate changes the size of the device to size bytes,
+	// discarding anything past the end
+	Truncate(size int64) error
+
+	// Sync flushes any changes to stable storage
+	Sync() error
+
+	// Close syncs and releases the device
+	Close() error
+}
+
+// Opener opens, or creates, the device with the given name.  Devices
+// opened read-only return gofs.ErrReadOnly from every change.
+type Opener func(name string, readOnly bool) (BlockDevice, error)
@@ -0,0 +1,208 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deathly809/gofs"
+)
+
+var testData = []byte("asdfgasdfgasdfgasdfgasdfgasdfg")
+
+var openers = map[string]Opener{
+	"mmap":   OpenMmap,
+	"file":   OpenFile,
+	"memory": OpenMemory,
+	"faulty": NewFaultyDisk().Open,
+}
+
+func testPath(kind string) string {
+	return filepath.Join(os.TempDir(), "devicedata-"+kind)
+}
+
+func TestReadWrite(t *testing.T) {
+	for kind, open := range openers {
+		path := testPath(kind)
+		os.Remove(path)
+		defer os.Remove(path)
+
+		dev, err := open(path, false)
+		if err != nil {
+			t.Error(kind, ": ", err.Error())
+			continue
+		}
+
+		if dev.Size() != 0 {
+			t.Error(kind, ": new device not empty")
+		}
+
+		// Leaves a gap which must read as zeros
+		if n, err := dev.WriteAt(testData, 100); n != len(testData) || err != nil {
+			t.Error(kind, ": did not write all data: ", err)
+		}
+
+		if dev.Size() != 100+int64(len(testData)) {
+			t.Error(kind, ": incorrect size: ", dev.Size())
+		}
+
+		data := make([]byte, 100+len(testData))
+		if n, err := dev.ReadAt(data, 0); n != len(data) || (err != nil && err != io.EOF) {
+			t.Error(kind, ": did not read all data: ", err)
+		}
+
+		if !bytes.Equal(data[:100], make([]byte, 100)) || !bytes.Equal(data[100:], testData) {
+			t.Error(kind, ": data not the same")
+		}
+
+		if n, err := dev.ReadAt(data, 110); n != len(testData)-10 || err != io.EOF {
+			t.Error(kind, ": read past the end did not return io.EOF: ", n, err)
+		}
+
+		if err = dev.Grow(4096); err != nil || dev.Size() != 4096 {
+			t.Error(kind, ": did not grow: ", err)
+		}
+
+		if err = dev.Truncate(100); err != nil || dev.Size() != 100 {
+			t.Error(kind, ": did not truncate: ", err)
+		}
+
+		if err = dev.Sync(); err != nil {
+			t.Error(kind, ": ", err.Error())
+		}
+
+		if err = dev.Close(); err != nil {
+			t.Error(kind, ": ", err.Error())
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	for kind, open := range openers {
+		if kind == "memory" {
+			continue
+		}
+
+		path := testPath(kind + "-ro")
+		os.Remove(path)
+		defer os.Remove(path)
+
+		dev, err := open(path, false)
+		if err != nil {
+			t.Error(kind, ": ", err.Error())
+			continue
+		}
+		dev.WriteAt(testData, 0)
+		dev.Close()
+
+		dev, err = open(path, true)
+		if err != nil {
+			t.Error(kind, ": ", err.Error())
+			continue
+		}
+
+		data := make([]byte, len(testData))
+		if n, err := dev.ReadAt(data, 0); n != len(data) || !bytes.Equal(data, testData) {
+			t.Error(kind, ": data not the same: ", err)
+		}
+
+		if _, err = dev.WriteAt(testData, 0); err != gofs.ErrReadOnly {
+			t.Error(kind, ": write to a read-only device did not fail: ", err)
+		}
+		dev.Close()
+	}
+}
+
+// Reads the whole device
+func contents(t *testing.T, dev BlockDevice) []byte {
+	data := make([]byte, dev.Size())
+	if n, err := dev.ReadAt(data, 0); n != len(data) || (err != nil && err != io.EOF) {
+		t.Fatal("could not read device: ", err)
+	}
+	return data
+}
+
+func TestFaultyDisk_Crash(t *testing.T) {
+	disk := NewFaultyDisk()
+	dev, _ := disk.Open("test", false)
+
+	synced := bytes.Repeat([]byte{1}, 4*SectorSize)
+	dev.WriteAt(synced, 0)
+	if err := dev.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	unsynced := bytes.Repeat([]byte{2}, 4*SectorSize)
+	dev.WriteAt(unsynced, 0)
+	dev.Grow(8 * SectorSize)
+
+	if !bytes.Equal(contents(t, dev)[:len(unsynced)], unsynced) {
+		t.Error("unsynced write not seen before the crash")
+	}
+
+	seen := make(map[string]bool)
+	for seed := int64(0); seed < 100; seed++ {
+		crashed, err := disk.Crash(rand.New(rand.NewSource(seed)), true).Open("test", true)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := contents(t, crashed)
+		if len(data) != len(synced) && len(data) != 8*SectorSize {
+			t.Fatal("incorrect size after crash: ", len(data))
+		}
+
+		// Each sector is either old or new
+		for i := 0; i < len(synced); i += SectorSize {
+			sector := data[i : i+SectorSize]
+			if !bytes.Equal(sector, synced[:SectorSize]) && !bytes.Equal(sector, unsynced[:SectorSize]) {
+				t.Fatal("sector ", i/SectorSize, " is neither old nor new")
+			}
+			seen[fmt.Sprint(sector[0], i == 0)] = true
+		}
+	}
+
+	if len(seen) != 4 {
+		t.Error("unsynced writes were not dropped, kept and torn: ", seen)
+	}
+}
+
+func TestFaultyDisk_Faults(t *testing.T) {
+	injected := errors.New("injected")
+
+	disk := NewFaultyDisk()
+	dev, _ := disk.Open("test", false)
+
+	disk.Inject(FailAt(OpWrite, 2, injected))
+	if _, err := dev.WriteAt(testData, 0); err != nil {
+		t.Error(err)
+	} else if _, err = dev.WriteAt(testData, 0); err != injected {
+		t.Error("second write did not fail: ", err)
+	} else if _, err = dev.WriteAt(testData, 0); err != nil {
+		t.Error("third write failed: ", err)
+	}
+
+	if disk.Count(OpWrite) != 3 {
+		t.Error("incorrect number of writes: ", disk.Count(OpWrite))
+	}
+
+	disk.Inject(PowerOffAt(OpSync, 1))
+	if err := dev.Sync(); err != ErrPowerLoss {
+		t.Error("sync did not lose power: ", err)
+	} else if _, err = dev.ReadAt(make([]byte, 1), 0); err != ErrPowerLoss {
+		t.Error("read after losing power did not fail: ", err)
+	} else if _, err = disk.Open("other", false); err != ErrPowerLoss {
+		t.Error("open after losing power did not fail: ", err)
+	}
+
+	// Nothing was ever synced
+	crashed, _ := disk.Crash(rand.New(rand.NewSource(0)), false).Open("test", false)
+	if crashed.Size() != 0 && !bytes.Equal(contents(t, crashed), testData) {
+		t.Error("crashed device holds data never written")
+	}
+}
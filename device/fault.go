@@ -0,0 +1,317 @@
+package device
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+
+	"github.com/deathly809/gofs"
+)
+
+// SectorSize is the unit a torn write is cut at.  Writes of a whole
+// sector either reach the disk or do not.
+const SectorSize = 512
+
+// ErrPowerLoss is returned by every operation on a FaultyDisk once
+// it has lost power
+var ErrPowerLoss = errors.New("Power lost")
+
+// Op is a kind of operation on a device of a FaultyDisk
+type Op int
+
+// The operations a Fault is consulted about
+const (
+	OpRead Op = iota
+	OpWrite
+	OpResize
+	OpSync
+)
+
+// Fault is called before every operation on a FaultyDisk with the
+// name of the device and how many operations of that kind the disk
+// has seen, counting from one.  Returning an error fails the
+// operation without performing it.  Returning ErrPowerLoss also
+// makes every later operation fail.
+type Fault func(name string, op Op, count int64) error
+
+// FailAt returns a Fault which fails the count'th operation of the
+// kind with err
+func FailAt(op Op, count int64, err error) Fault {
+	return func(name string, o Op, n int64) error {
+		if o == op && n == count {
+			return err
+		}
+		return nil
+	}
+}
+
+// PowerOffAt returns a Fault which cuts the power just before the
+// count'th operation of the kind
+func PowerOffAt(op Op, count int64) Fault {
+	return FailAt(op, count, ErrPowerLoss)
+}
+
+// FaultyDisk holds named devices in memory and keeps track of which
+// of their changes would survive losing power.  Writes and resizes
+// are only durable once the device they were made on is synced;
+// Crash returns the disk as it could be found after power is lost.
+type FaultyDisk struct {
+	lock    sync.Mutex
+	stores  map[string]*store
+	counts  map[Op]int64
+	fault   Fault
+	powered bool
+}
+
+// The contents of a device on a FaultyDisk
+type store struct {
+	live    []byte   // what reads see
+	durable []byte   // what survives a crash
+	pending []change // changes made since the last sync, oldest first
+}
+
+// A write, or a resize when data is nil
+type change struct {
+	offset int64
+	data   []byte
+	size   int64
+}
+
+// NewFaultyDisk returns a disk without any devices
+func NewFaultyDisk() *FaultyDisk {
+	return &FaultyDisk{
+		stores:  make(map[string]*store),
+		counts:  make(map[Op]int64),
+		powered: true,
+	}
+}
+
+// Inject consults the fault before every later operation.  A nil
+// fault stops injecting.
+func (disk *FaultyDisk) Inject(fault Fault) {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	disk.fault = fault
+}
+
+// PowerOff makes every later operation fail with ErrPowerLoss
+func (disk *FaultyDisk) PowerOff() {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	disk.powered = false
+}
+
+// Count returns how many operations of the kind the disk has seen
+func (disk *FaultyDisk) Count(op Op) int64 {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	return disk.counts[op]
+}
+
+// Open opens the device with the name, creating it if needed.  It
+// is a device.Opener.
+func (disk *FaultyDisk) Open(name string, readOnly bool) (BlockDevice, error) {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	if !disk.powered {
+		return nil, ErrPowerLoss
+	}
+
+	s, exists := disk.stores[name]
+	if !exists {
+		if readOnly {
+			return nil, os.ErrNotExist
+		}
+		s = &store{}
+		disk.stores[name] = s
+	}
+	return &faultyDevice{disk: disk, name: name, store: s, readOnly: readOnly}, nil
+}
+
+// Crash returns a new disk holding what could be found on this one
+// after losing power.  Every change made since its device was last
+// synced is kept or dropped at random, as disks may write them in
+// any order.  When torn is true a kept write may also be cut short
+// at a sector boundary.
+func (disk *FaultyDisk) Crash(r *rand.Rand, torn bool) *FaultyDisk {
+	disk.lock.Lock()
+	defer disk.lock.Unlock()
+
+	result := NewFaultyDisk()
+	for name, s := range disk.stores {
+		image := append([]byte(nil), s.durable...)
+		for _, c := range s.pending {
+			if r.Intn(2) == 0 {
+				continue
+			}
+
+			if c.data != nil && torn && len(c.data) > SectorSize && r.Intn(2) == 0 {
+				sectors := (len(c.data) + SectorSize - 1) / SectorSize
+				c.data = c.data[:r.Intn(sectors)*SectorSize]
+			}
+			image = c.apply(image)
+		}
+
+		result.stores[name] = &store{
+			live:    image,
+			durable: append([]byte(nil), image...),
+		}
+	}
+	return result
+}
+
+// Applies the change to the contents of a device
+func (c change) apply(image []byte) []byte {
+	if c.data == nil {
+		return resize(image, c.size)
+	}
+
+	end := c.offset + int64(len(c.data))
+	if end > int64(len(image)) {
+		image = resize(image, end)
+	}
+	copy(image[c.offset:], c.data)
+	return image
+}
+
+// Returns the data cut or zero filled to size bytes
+func resize(data []byte, size int64) []byte {
+	if size <= int64(len(data)) {
+		return data[:size]
+	}
+	return append(data, make([]byte, size-int64(len(data)))...)
+}
+
+// Counts the operation and asks the fault about it.  Must be called
+// with the lock held.
+func (disk *FaultyDisk) check(name string, op Op) error {
+	if !disk.powered {
+		return ErrPowerLoss
+	}
+
+	disk.counts[op]++
+	if disk.fault == nil {
+		return nil
+	}
+
+	err := disk.fault(name, op, disk.counts[op])
+	if err == ErrPowerLoss {
+		disk.powered = false
+	}
+	return err
+}
+
+// A handle to a device of a FaultyDisk
+type faultyDevice struct {
+	disk     *FaultyDisk
+	name     string
+	store    *store
+	readOnly bool
+}
+
+func (dev *faultyDevice) ReadAt(data []byte, offset int64) (int, error) {
+	dev.disk.lock.Lock()
+	defer dev.disk.lock.Unlock()
+
+	if err := dev.disk.check(dev.name, OpRead); err != nil {
+		return 0, err
+	} else if offset < 0 {
+		return 0, errors.New("Cannot read at a negative offset")
+	} else if offset >= int64(len(dev.store.live)) {
+		return 0, io.EOF
+	}
+
+	n := copy(data, dev.store.live[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (dev *faultyDevice) WriteAt(data []byte, offset int64) (int, error) {
+	dev.disk.lock.Lock()
+	defer dev.disk.lock.Unlock()
+
+	if dev.readOnly {
+		return 0, gofs.ErrReadOnly
+	} else if err := dev.disk.check(dev.name, OpWrite); err != nil {
+		return 0, err
+	} else if offset < 0 {
+		return 0, errors.New("Cannot write at a negative offset")
+	}
+
+	dev.change(change{offset: offset, data: append([]byte(nil), data...)})
+	return len(data), nil
+}
+
+// Makes the change seen by reads and remembers it until the next sync
+func (dev *faultyDevice) change(c change) {
+	dev.store.live = c.apply(dev.store.live)
+	dev.store.pending = append(dev.store.pending, c)
+}
+
+func (dev *faultyDevice) Size() int64 {
+	dev.disk.lock.Lock()
+	defer dev.disk.lock.Unlock()
+
+	return int64(len(dev.store.live))
+}
+
+func (dev *faultyDevice) Grow(size int64) error {
+	dev.disk.lock.Lock()
+	defer dev.disk.lock.Unlock()
+
+	if size <= int64(len(dev.store.live)) {
+		return nil
+	}
+	return dev.resize(size)
+}
+
+func (dev *faultyDevice) Truncate(size int64) error {
+	dev.disk.lock.Lock()
+	defer dev.disk.lock.Unlock()
+
+	if size < 0 {
+		return errors.New("Cannot truncate to a negative size")
+	}
+	return dev.resize(size)
+}
+
+// Must be called with the lock held
+func (dev *faultyDevice) resize(size int64) error {
+	if dev.readOnly {
+		return gofs.ErrReadOnly
+	} else if err := dev.disk.check(dev.name, OpResize); err != nil {
+		return err
+	}
+
+	dev.change(change{size: size})
+	return nil
+}
+
+func (dev *faultyDevice) Sync() error {
+	dev.disk.lock.Lock()
+	defer dev.disk.lock.Unlock()
+
+	if err := dev.disk.check(dev.name, OpSync); err != nil {
+		return err
+	}
+
+	for _, c := range dev.store.pending {
+		dev.store.durable = c.apply(dev.store.durable)
+	}
+	dev.store.pending = nil
+	return nil
+}
+
+// Close does not sync, changes which were not synced can still be
+// lost
+func (dev *faultyDevice) Close() error {
+	return nil
+}
@@ -0,0 +1,77 @@
+package device
+
+import (
+	"os"
+
+	"github.com/deathly809/gofs"
+)
+
+// A device backed by a file read and written with pread and pwrite
+type fileDevice struct {
+	file     *os.File
+	readOnly bool
+}
+
+// OpenFile opens a file as a device without memory mapping it
+func OpenFile(name string, readOnly bool) (BlockDevice, error) {
+	flag := os.O_CREATE | os.O_RDWR
+	if readOnly {
+		flag = os.O_RDONLY
+	}
+
+	file, err := os.OpenFile(name, flag, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &fileDevice{file: file, readOnly: readOnly}, nil
+}
+
+func (dev *fileDevice) ReadAt(data []byte, offset int64) (int, error) {
+	return dev.file.ReadAt(data, offset)
+}
+
+func (dev *fileDevice) WriteAt(data []byte, offset int64) (int, error) {
+	if dev.readOnly {
+		return 0, gofs.ErrReadOnly
+	}
+	return dev.file.WriteAt(data, offset)
+}
+
+func (dev *fileDevice) Size() int64 {
+	info, err := dev.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
+
+func (dev *fileDevice) Grow(size int64) error {
+	if dev.readOnly {
+		return gofs.ErrReadOnly
+	} else if size <= dev.Size() {
+		return nil
+	}
+	return dev.file.Truncate(size)
+}
+
+func (dev *fileDevice) Truncate(size int64) error {
+	if dev.readOnly {
+		return gofs.ErrReadOnly
+	}
+	return dev.file.Truncate(size)
+}
+
+func (dev *fileDevice) Sync() error {
+	if dev.readOnly {
+		return nil
+	}
+	return dev.file.Sync()
+}
+
+func (dev *fileDevice) Close() error {
+	err := dev.Sync()
+	if e := dev.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
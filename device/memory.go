@@ -0,0 +1,118 @@
+package device
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// A device which only keeps its bytes in memory
+type memoryDevice struct {
+	lock sync.RWMutex
+	data []byte
+}
+
+// NewMemory creates an empty device kept in memory
+func NewMemory() BlockDevice {
+	return &memoryDevice{}
+}
+
+// OpenMemory creates an empty device kept in memory.  The name is
+// ignored, every call returns a new device.
+func OpenMemory(name string, readOnly bool) (BlockDevice, error) {
+	if readOnly {
+		return nil, errors.New("Cannot open a memory device read-only")
+	}
+	return NewMemory(), nil
+}
+
+func (dev *memoryDevice) ReadAt(data []byte, offset int64) (int, error) {
+	dev.lock.RLock()
+	defer dev.lock.RUnlock()
+
+	if offset < 0 {
+		return 0, errors.New("Cannot read at a negative offset")
+	} else if offset >= int64(len(dev.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(data, dev.data[offset:])
+	if n < len(data) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (dev *memoryDevice) WriteAt(data []byte, offset int64) (int, error) {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	if offset < 0 {
+		return 0, errors.New("Cannot write at a negative offset")
+	}
+
+	dev.grow(offset + int64(len(data)))
+	return copy(dev.data[offset:], data), nil
+}
+
+func (dev *memoryDevice) Size() int64 {
+	dev.lock.RLock()
+	defer dev.lock.RUnlock()
+
+	return int64(len(dev.data))
+}
+
+func (dev *memoryDevice) Grow(size int64) error {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	dev.grow(size)
+	return nil
+}
+
+// Extends the data to size bytes, doubling the space reserved so
+// appends take amortized constant time
+func (dev *memoryDevice) grow(size int64) {
+	if size <= int64(len(dev.data)) {
+		return
+	} else if size <= int64(cap(dev.data)) {
+		dev.data = dev.data[:size]
+		return
+	}
+
+	data := make([]byte, size, 2*size)
+	copy(data, dev.data)
+	dev.data = data
+}
+
+func (dev *memoryDevice) Truncate(size int64) error {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	if size < 0 {
+		return errors.New("Cannot truncate to a negative size")
+	} else if size > int64(len(dev.data)) {
+		dev.grow(size)
+		return nil
+	}
+
+	// Clear what is cut off so growing again gives zeros
+	tail := dev.data[size:]
+	for i := range tail {
+		tail[i] = 0
+	}
+	dev.data = dev.data[:size]
+	return nil
+}
+
+func (dev *memoryDevice) Sync() error {
+	return nil
+}
+
+func (dev *memoryDevice) Close() error {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	dev.data = nil
+	return nil
+}
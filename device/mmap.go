@@ -0,0 +1,108 @@
+package device
+
+import (
+	"io"
+	"os"
+	"sync"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/mmap"
+)
+
+// A device backed by a memory mapped file
+type mmapDevice struct {
+	lock     sync.Mutex // keeps each seek with the read or write after it
+	file     mmap.File
+	readOnly bool
+}
+
+// OpenMmap opens a memory mapped file as a device.  Writes are only
+// flushed to disk by Sync and Close, as the users of a device sync
+// when they need to.
+func OpenMmap(name string, readOnly bool) (BlockDevice, error) {
+	opts := []mmap.Option{mmap.SyncOnClose()}
+	if readOnly {
+		opts = append(opts, mmap.ReadOnly())
+	}
+
+	file, err := mmap.NewFile(name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return &mmapDevice{file: file.(mmap.File), readOnly: readOnly}, nil
+}
+
+func (dev *mmapDevice) ReadAt(data []byte, offset int64) (int, error) {
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	if offset >= dev.file.Size() {
+		return 0, io.EOF
+	} else if _, err := dev.file.Seek(offset, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+
+	n, err := dev.file.Read(data)
+	if err == nil && n < len(data) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+func (dev *mmapDevice) WriteAt(data []byte, offset int64) (int, error) {
+	if dev.readOnly {
+		return 0, gofs.ErrReadOnly
+	}
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	// Seeks stop at the end of the file so fill any gap first
+	if offset > dev.file.Size() {
+		if err := dev.file.Truncate(offset); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := dev.file.Seek(offset, os.SEEK_SET); err != nil {
+		return 0, err
+	}
+	return dev.file.Write(data)
+}
+
+func (dev *mmapDevice) Size() int64 {
+	return dev.file.Size()
+}
+
+func (dev *mmapDevice) Grow(size int64) error {
+	if dev.readOnly {
+		return gofs.ErrReadOnly
+	}
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	if size <= dev.file.Size() {
+		return nil
+	}
+	return dev.file.Truncate(size)
+}
+
+func (dev *mmapDevice) Truncate(size int64) error {
+	if dev.readOnly {
+		return gofs.ErrReadOnly
+	}
+
+	dev.lock.Lock()
+	defer dev.lock.Unlock()
+
+	return dev.file.Truncate(size)
+}
+
+func (dev *mmapDevice) Sync() error {
+	return dev.file.Sync()
+}
+
+func (dev *mmapDevice) Close() error {
+	return dev.file.Close()
+}
@@ -0,0 +1,13 @@
+package gofs
+
+import "errors"
+
+var (
+	// ErrReadOnly is returned when a change is attempted on a file
+	// or file system which was opened read-only
+	ErrReadOnly = errors.New("gofs: read-only")
+
+	// ErrClosed is returned by any call made after a file system
+	// has been shut down
+	ErrClosed = errors.New("gofs: file system closed")
+)
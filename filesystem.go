@@ -1,6 +1,10 @@
 package gofs
 
-import "io"
+import (
+	"context"
+	"io"
+	"time"
+)
 
 // FileSystem is an interface into your brain
 type FileSystem interface {
@@ -26,12 +30,15 @@ type FileSystem interface {
 
 	//	Shutdown safely closes the file system
 	//
-	//  All reads and writes in progress will finish and
-	//	further I/O will result in an error.
+	//	No new files may be opened once Shutdown is called.
+	//  All reads, writes and locks in progress will finish
+	//	and further I/O will result in ErrClosed.  If the
+	//	context expires first the file system is closed
+	//	anyway and the context's error is returned.
 	//
 	//	Any future calls to the FileSystem object will
-	//	have no effect.
-	Shutdown()
+	//	have no effect or return ErrClosed.
+	Shutdown(context.Context) error
 
 	//	Lock provides exclusive access to a file.
 	//
@@ -66,7 +73,53 @@ type FileSystem interface {
 
 	//	Delete removes an existing file from the filesystem
 	//
-	//	If the file does not exist nothing happens
+	//	The name is removed immediately but the contents
+	//	remain readable through handles which are already
+	//	open until the last of them is closed.
 	//
-	Delete(string)
+	//	If the file does not exist nothing happens and nil
+	//	is returned.
+	//
+	Delete(string) error
+
+	//	Stat returns information about the file with the
+	//	given name
+	//
+	//	If the file does not exist nil is returned
+	//
+	Stat(string) FileStats
+}
+
+// TimeSetter is implemented by file systems which can change when a
+// file was last modified, such as to keep the times of files copied
+// in from elsewhere
+type TimeSetter interface {
+
+	//	SetLastModified changes the time the file with the given
+	//	name was last modified
+	//
+	//	An error is returned if the file does not exist
+	//
+	SetLastModified(string, time.Time) error
+}
+
+// Lister is implemented by file systems which can list their files
+type Lister interface {
+
+	//	Names returns the names of every file in the file system
+	//	in sorted order
+	//
+	Names() []string
+}
+
+// Renamer is implemented by file systems which can move a file to a
+// new name in a single step
+type Renamer interface {
+
+	//	Rename moves the file to the new name, replacing any file
+	//	which has it.  Either the file is moved or nothing changes.
+	//
+	//	An error is returned if the file does not exist
+	//
+	Rename(oldName, newName string) error
 }
@@ -18,7 +18,6 @@ const (
 )
 
 // FileStats holds information related to a file
-// TODO: Use this and fill it out
 type FileStats interface {
 	// Created returns the date and time the file was created
 	Created() time.Time
@@ -0,0 +1,622 @@
+// Package fstest checks that an implementation of gofs.FileSystem
+// follows the contract of the interface.
+//
+// An implementation is validated from its own tests by handing
+// TestFileSystem a function which returns a new, empty file system
+// on every call:
+//
+//	func TestConformance(t *testing.T) {
+//		fstest.TestFileSystem(t, memfs.New)
+//	}
+package fstest
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/deathly809/gofs"
+)
+
+// BlockSize is the largest block size of the backends in this
+// repository.  Data is written in sizes around multiples of it so
+// reads and writes cross block boundaries.
+const BlockSize = 4096
+
+// How long to wait before deciding a blocked call stays blocked
+const blockedWait = 50 * time.Millisecond
+
+// The sizes used for round trips
+var sizes = []int{0, 1, BlockSize - 1, BlockSize, BlockSize + 1, 3*BlockSize + 17}
+
+// TestFileSystem runs every check against file systems returned by
+// newFS.  Each check gets a file system of its own and shuts it down
+// when it is done.
+func TestFileSystem(t *testing.T, newFS func() gofs.FileSystem) {
+	tests := []struct {
+		name string
+		test func(*testing.T, gofs.FileSystem)
+	}{
+		{"Open", testOpen},
+		{"Seek", testSeek},
+		{"RoundTrip", testRoundTrip},
+		{"Overwrite", testOverwrite},
+		{"Close", testClose},
+		{"Delete", testDelete},
+		{"SetLastModified", testSetLastModified},
+		{"Names", testNames},
+		{"Handles", testHandles},
+		{"Lock", testLock},
+		{"SafeReaderWriter", testSafeReaderWriter},
+		{"Concurrent", testConcurrent},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			fs := newFS()
+			if fs == nil {
+				t.Fatal("could not create a file system")
+			}
+			defer fs.Shutdown(context.Background())
+			tt.test(t, fs)
+		})
+	}
+
+	t.Run("Shutdown", func(t *testing.T) {
+		testShutdown(t, newFS())
+	})
+	t.Run("ShutdownWait", func(t *testing.T) {
+		testShutdownWait(t, newFS())
+	})
+	t.Run("ShutdownTimeout", func(t *testing.T) {
+		testShutdownTimeout(t, newFS())
+	})
+}
+
+// Returns size bytes of data which differs from block to block
+func pattern(size, seed int) []byte {
+	result := make([]byte, size)
+	for i := range result {
+		result[i] = byte(i*7 + i/BlockSize + seed)
+	}
+	return result
+}
+
+// Reads the file from the beginning to the end
+func readAll(t *testing.T, file gofs.File) []byte {
+	if _, err := file.Seek(0, int(gofs.Beginning)); err != nil {
+		t.Fatal("could not seek to the beginning: ", err)
+	}
+
+	var result bytes.Buffer
+	buffer := make([]byte, BlockSize/3)
+	for {
+		n, err := file.Read(buffer)
+		result.Write(buffer[:n])
+		if err == io.EOF || (err == nil && n == 0) {
+			return result.Bytes()
+		} else if err != nil {
+			t.Fatal("could not read: ", err)
+		}
+	}
+}
+
+// Returns true if the channel is closed before blockedWait passes
+func finished(done <-chan struct{}) bool {
+	select {
+	case <-done:
+		return true
+	case <-time.After(blockedWait):
+		return false
+	}
+}
+
+func testOpen(t *testing.T, fs gofs.FileSystem) {
+	if fs.Open("") != nil {
+		t.Error("opened a file without a name")
+	}
+
+	if fs.Exists("test") || fs.Stat("test") != nil {
+		t.Error("file exists before it was opened")
+	}
+
+	file := fs.Open("test")
+	if file == nil {
+		t.Fatal("could not create a file")
+	} else if !file.IsNew() {
+		t.Error("created file is not new")
+	} else if file.Name() != "test" {
+		t.Error("incorrect name: ", file.Name())
+	}
+
+	if !fs.Exists("test") {
+		t.Error("created file does not exist")
+	}
+
+	if stats := fs.Stat("test"); stats == nil {
+		t.Error("no stats for a created file")
+	} else if stats.Size() != 0 || file.Size() != 0 {
+		t.Error("created file is not empty")
+	}
+	file.Close()
+
+	file = fs.Open("test")
+	if file == nil || file.IsNew() {
+		t.Error("existing file is new")
+	}
+	file.Close()
+}
+
+func testSeek(t *testing.T, fs gofs.FileSystem) {
+	file := fs.Open("test")
+	defer file.Close()
+
+	file.Write(pattern(100, 0))
+
+	seeks := []struct {
+		offset int64
+		from   gofs.FileOffset
+		want   int64
+	}{
+		{10, gofs.Beginning, 10},
+		{-5, gofs.Beginning, 0},
+		{500, gofs.Beginning, 100},
+		{-10, gofs.End, 90},
+		{5, gofs.End, 100},
+		{-200, gofs.End, 0},
+		{30, gofs.Current, 30},
+		{20, gofs.Current, 50},
+		{-60, gofs.Current, 0},
+		{1000, gofs.Current, 100},
+	}
+
+	for _, s := range seeks {
+		if pos, err := file.Seek(s.offset, int(s.from)); err != nil || pos != s.want {
+			t.Errorf("Seek(%d, %d) = %d, %v; want %d", s.offset, s.from, pos, err, s.want)
+		}
+	}
+
+	file.Seek(40, int(gofs.Beginning))
+	if _, err := file.Seek(0, 99); err == nil {
+		t.Error("seek from an invalid origin did not fail")
+	}
+
+	data := make([]byte, 1)
+	if n, err := file.Read(data); n != 1 || err != nil || data[0] != pattern(100, 0)[40] {
+		t.Error("invalid seek moved the position")
+	}
+}
+
+func testRoundTrip(t *testing.T, fs gofs.FileSystem) {
+	for _, size := range sizes {
+		name := fmt.Sprint("test-", size)
+		want := pattern(size, size)
+
+		file := fs.Open(name)
+		if n, err := file.Write(want); n != size || err != nil {
+			t.Errorf("%s: wrote %d of %d bytes: %v", name, n, size, err)
+		}
+
+		if file.Size() != int64(size) {
+			t.Errorf("%s: incorrect size %d", name, file.Size())
+		}
+
+		if n, err := file.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+			t.Errorf("%s: read at the end returned %d, %v", name, n, err)
+		}
+		file.Close()
+
+		file = fs.Open(name)
+		if got := readAll(t, file); !bytes.Equal(got, want) {
+			t.Errorf("%s: data not the same after reopening", name)
+		}
+
+		if stats := fs.Stat(name); stats == nil || stats.Size() != size {
+			t.Errorf("%s: incorrect stats", name)
+		}
+		file.Close()
+	}
+
+	// Many small writes which each cross a boundary sooner or later
+	file := fs.Open("appended")
+	defer file.Close()
+
+	want := pattern(2*BlockSize+100, 3)
+	for i := 0; i < len(want); i += 100 {
+		end := i + 100
+		if end > len(want) {
+			end = len(want)
+		}
+		file.Write(want[i:end])
+	}
+
+	if got := readAll(t, file); !bytes.Equal(got, want) {
+		t.Error("appended data not the same")
+	}
+}
+
+func testOverwrite(t *testing.T, fs gofs.FileSystem) {
+	file := fs.Open("test")
+	defer file.Close()
+
+	want := pattern(3*BlockSize, 0)
+	file.Write(want)
+
+	// Replace a range spanning a boundary
+	patch := pattern(BlockSize, 5)
+	offset := BlockSize / 2
+	file.Seek(int64(offset), int(gofs.Beginning))
+	if n, err := file.Write(patch); n != len(patch) || err != nil {
+		t.Error("did not overwrite all data: ", err)
+	}
+	copy(want[offset:], patch)
+
+	// And extend the file from before its end
+	tail := pattern(BlockSize, 9)
+	file.Seek(-100, int(gofs.End))
+	file.Write(tail)
+	want = append(want[:len(want)-100], tail...)
+
+	if file.Size() != int64(len(want)) {
+		t.Error("incorrect size: ", file.Size())
+	}
+
+	if got := readAll(t, file); !bytes.Equal(got, want) {
+		t.Error("data not the same after overwriting")
+	}
+}
+
+func testClose(t *testing.T, fs gofs.FileSystem) {
+	file := fs.Open("test")
+
+	if err := file.Close(); err != nil {
+		t.Error(err)
+	} else if err := file.Close(); err == nil {
+		t.Error("closed a file twice")
+	}
+
+	if _, err := file.Write([]byte("data")); err == nil {
+		t.Error("wrote to a closed file")
+	} else if _, err := file.Read(make([]byte, 1)); err == nil {
+		t.Error("read from a closed file")
+	} else if _, err := file.Seek(0, int(gofs.Beginning)); err == nil {
+		t.Error("seeked in a closed file")
+	}
+}
+
+func testDelete(t *testing.T, fs gofs.FileSystem) {
+	if err := fs.Delete("missing"); err != nil {
+		t.Error("deleting a missing file failed: ", err)
+	}
+
+	want := pattern(2*BlockSize, 1)
+	file := fs.Open("test")
+	file.Write(want)
+
+	if err := fs.Delete("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.Exists("test") || fs.Stat("test") != nil {
+		t.Error("file still exists after delete")
+	}
+
+	// Open handles keep the contents until they are closed
+	if got := readAll(t, file); !bytes.Equal(got, want) {
+		t.Error("handle lost data after delete")
+	}
+
+	again := fs.Open("test")
+	if again == nil || !again.IsNew() || again.Size() != 0 {
+		t.Error("deleted file was not replaced by a new one")
+	}
+	again.Write(pattern(10, 2))
+
+	if err := file.Close(); err != nil {
+		t.Error("could not close a deleted file: ", err)
+	}
+
+	if got := readAll(t, again); !bytes.Equal(got, pattern(10, 2)) {
+		t.Error("closing a deleted file changed its replacement")
+	}
+	again.Close()
+}
+
+// Only run for file systems which are a gofs.TimeSetter
+func testSetLastModified(t *testing.T, fs gofs.FileSystem) {
+	setter, ok := fs.(gofs.TimeSetter)
+	if !ok {
+		t.Skip("not a gofs.TimeSetter")
+	}
+
+	if err := setter.SetLastModified("missing", time.Now()); err == nil {
+		t.Error("set the time of a missing file")
+	}
+
+	file := fs.Open("test")
+	file.Write(pattern(10, 1))
+	file.Close()
+
+	// Whole seconds are kept by every host
+	want := time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+	if err := setter.SetLastModified("test", want); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fs.Stat("test").LastModified(); !got.Equal(want) {
+		t.Errorf("last modified is %v, want %v", got, want)
+	}
+}
+
+// Only run for file systems which are a gofs.Lister
+func testNames(t *testing.T, fs gofs.FileSystem) {
+	lister, ok := fs.(gofs.Lister)
+	if !ok {
+		t.Skip("not a gofs.Lister")
+	}
+
+	if names := lister.Names(); len(names) != 0 {
+		t.Errorf("new file system has files %v", names)
+	}
+
+	for _, name := range []string{"b", "a", "c"} {
+		fs.Open(name).Close()
+	}
+	fs.Delete("c")
+
+	if names := lister.Names(); fmt.Sprint(names) != "[a b]" {
+		t.Errorf("names are %v, want [a b]", names)
+	}
+}
+
+func testHandles(t *testing.T, fs gofs.FileSystem) {
+	first := fs.Open("test")
+	second := fs.Open("test")
+
+	if stats := fs.Stat("test"); stats == nil || len(stats.Handles()) != 2 {
+		t.Error("incorrect number of handles")
+	}
+
+	// Handles share contents but not positions
+	first.Write([]byte("abc"))
+	data := make([]byte, 3)
+	if n, _ := second.Read(data); n != 3 || string(data) != "abc" {
+		t.Error("handles do not share contents")
+	}
+
+	first.Close()
+	if stats := fs.Stat("test"); stats == nil || len(stats.Handles()) != 1 {
+		t.Error("closed handle still listed")
+	}
+
+	second.Close()
+	if stats := fs.Stat("test"); stats == nil || len(stats.Handles()) != 0 {
+		t.Error("closed handles still listed")
+	}
+}
+
+func testLock(t *testing.T, fs gofs.FileSystem) {
+	owner := fs.Open("test")
+	other := fs.Open("test")
+	defer owner.Close()
+
+	fs.Lock(owner)
+
+	// The owner may lock again and still use the file
+	fs.Lock(owner)
+	if _, err := owner.Write([]byte("owner")); err != nil {
+		t.Error("owner could not write: ", err)
+	}
+
+	written := make(chan struct{})
+	go func() {
+		other.Write([]byte("other"))
+		close(written)
+	}()
+
+	if finished(written) {
+		t.Error("wrote to a file locked by another handle")
+	}
+
+	fs.Unlock(other)
+	if finished(written) {
+		t.Error("lock released by a handle which does not hold it")
+	}
+
+	locked := make(chan struct{})
+	go func() {
+		fs.Lock(other)
+		close(locked)
+	}()
+
+	if finished(locked) {
+		t.Error("locked a file locked by another handle")
+	}
+
+	fs.Unlock(owner)
+	<-written
+	<-locked
+
+	// Closing the handle holding the lock releases it
+	other.Close()
+	fs.Lock(owner)
+	fs.Unlock(owner)
+}
+
+func testSafeReaderWriter(t *testing.T, fs gofs.FileSystem) {
+	if fs.GetSafeReader(nil) != nil || fs.GetSafeWriter(nil) != nil {
+		t.Error("safe reader or writer for no file")
+	}
+
+	file := fs.Open("test")
+	defer file.Close()
+
+	want := pattern(BlockSize+1, 4)
+	if n, err := fs.GetSafeWriter(file).Write(want); n != len(want) || err != nil {
+		t.Error("safe writer did not write all data: ", err)
+	}
+
+	file.Seek(0, int(gofs.Beginning))
+	got := make([]byte, len(want))
+	if n, err := io.ReadFull(fs.GetSafeReader(file), got); n != len(want) || err != nil {
+		t.Error("safe reader did not read all data: ", err)
+	} else if !bytes.Equal(got, want) {
+		t.Error("data not the same")
+	}
+}
+
+func testConcurrent(t *testing.T, fs gofs.FileSystem) {
+	const workers = 8
+	const records = 50
+	const recordSize = 100
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*workers)
+
+	// Each worker has a file of its own
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			name := fmt.Sprint("own-", w)
+			want := pattern(2*BlockSize+w, w)
+
+			file := fs.Open(name)
+			defer file.Close()
+			file.Write(want)
+
+			got := make([]byte, len(want))
+			file.Seek(0, int(gofs.Beginning))
+			if _, err := io.ReadFull(file, got); err != nil || !bytes.Equal(got, want) {
+				errs <- fmt.Errorf("%s: data not the same: %v", name, err)
+			}
+
+			if stats := fs.Stat(name); stats == nil || stats.Size() != len(want) {
+				errs <- fmt.Errorf("%s: incorrect stats", name)
+			}
+		}(w)
+	}
+
+	// And all of them append records to a shared handle
+	shared := fs.Open("shared")
+	defer shared.Close()
+	writer := fs.GetSafeWriter(shared)
+
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			record := bytes.Repeat([]byte{byte('a' + w)}, recordSize)
+			for i := 0; i < records; i++ {
+				if n, err := writer.Write(record); n != recordSize || err != nil {
+					errs <- fmt.Errorf("shared: wrote %d of %d bytes: %v", n, recordSize, err)
+					return
+				}
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	data := readAll(t, shared)
+	if len(data) != workers*records*recordSize {
+		t.Fatal("incorrect size of shared file: ", len(data))
+	}
+
+	counts := make(map[byte]int)
+	for i := 0; i < len(data); i += recordSize {
+		record := data[i : i+recordSize]
+		if !bytes.Equal(record, bytes.Repeat(record[:1], recordSize)) {
+			t.Fatal("records written at the same time were mixed at ", i)
+		}
+		counts[record[0]]++
+	}
+
+	for w := 0; w < workers; w++ {
+		if counts[byte('a'+w)] != records {
+			t.Error("incorrect number of records from worker ", w)
+		}
+	}
+}
+
+func testShutdown(t *testing.T, fs gofs.FileSystem) {
+	file := fs.Open("test")
+	file.Write([]byte("data"))
+
+	if err := fs.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if fs.Open("test") != nil || fs.Open("other") != nil {
+		t.Error("opened a file after shutdown")
+	} else if fs.Exists("test") || fs.Stat("test") != nil {
+		t.Error("file visible after shutdown")
+	} else if err := fs.Delete("test"); err != gofs.ErrClosed {
+		t.Error("expected ErrClosed from delete: ", err)
+	}
+
+	if _, err := file.Write([]byte("data")); err != gofs.ErrClosed {
+		t.Error("expected ErrClosed from write: ", err)
+	} else if _, err := file.Read(make([]byte, 1)); err != gofs.ErrClosed {
+		t.Error("expected ErrClosed from read: ", err)
+	} else if _, err := file.Seek(0, int(gofs.Beginning)); err != gofs.ErrClosed {
+		t.Error("expected ErrClosed from seek: ", err)
+	}
+
+	if err := fs.Shutdown(context.Background()); err != gofs.ErrClosed {
+		t.Error("shut down twice: ", err)
+	}
+}
+
+// Shutdown waits for locks to be released
+func testShutdownWait(t *testing.T, fs gofs.FileSystem) {
+	file := fs.Open("test")
+	fs.Lock(file)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fs.Shutdown(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		t.Error("shutdown did not wait for a locked file: ", err)
+		return
+	case <-time.After(blockedWait):
+	}
+
+	fs.Unlock(file)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// Shutdown stops waiting once its context is done
+func testShutdownTimeout(t *testing.T, fs gofs.FileSystem) {
+	file := fs.Open("test")
+	fs.Lock(file)
+
+	ctx, cancel := context.WithTimeout(context.Background(), blockedWait)
+	defer cancel()
+
+	if err := fs.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("expected the context's error: ", err)
+	}
+
+	if fs.Open("test") != nil {
+		t.Error("opened a file after shutdown")
+	} else if _, err := file.Write([]byte("data")); err != gofs.ErrClosed {
+		t.Error("expected ErrClosed from write: ", err)
+	}
+}
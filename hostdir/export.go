@@ -0,0 +1,150 @@
+package hostdir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/deathly809/gofs"
+)
+
+// A file in the file system to copy out
+type fsFile struct {
+	name     string // name in the file system
+	path     string // path on the host
+	modified time.Time
+}
+
+// Export copies every file in the file system into the directory on
+// the host, creating the directories the names need.  Each file is
+// given the time it was last modified in the file system.
+//
+// The file system must be a gofs.Lister.  Names which would leave the
+// directory are an error, as are files which already exist on the
+// host unless Overwrite or SkipExisting is given.  Both are checked
+// before anything is copied.  Any other error stops the copy, files
+// copied before it are left on the host.
+func Export(fs gofs.FileSystem, hostDir string, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	lister, ok := fs.(gofs.Lister)
+	if !ok {
+		return errors.New("File system cannot list its files")
+	}
+
+	var files []fsFile
+	var progress Progress
+	for _, name := range lister.Names() {
+		if !o.wanted(name) {
+			continue
+		}
+
+		target, err := hostPath(hostDir, name)
+		if err != nil {
+			return err
+		}
+
+		if _, err = os.Lstat(target); err == nil {
+			if o.skipExisting {
+				continue
+			} else if !o.overwrite {
+				return fmt.Errorf("%s: %w", name, os.ErrExist)
+			}
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+
+		// Deleted since it was listed
+		stats := fs.Stat(name)
+		if stats == nil {
+			continue
+		}
+
+		files = append(files, fsFile{
+			name:     name,
+			path:     target,
+			modified: stats.LastModified(),
+		})
+		progress.TotalBytes += int64(stats.Size())
+	}
+	progress.TotalFiles = int64(len(files))
+
+	for _, f := range files {
+		n, err := o.exportFile(fs, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		o.report(&progress, f.name, n)
+	}
+	return nil
+}
+
+// Returns where the file with the name goes on the host
+func hostPath(dir, name string) (string, error) {
+	clean := path.Clean(name)
+	if len(name) == 0 || clean == "." || clean == ".." || path.IsAbs(clean) || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("%s: name is not within the directory", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(clean)), nil
+}
+
+// Copies a file from the file system to the host and returns how many
+// bytes were copied.  The file is copied to its end, which may have
+// moved since it was listed, and given the time it was last modified
+// when the copy finished.
+func (o *options) exportFile(fs gofs.FileSystem, f fsFile) (int64, error) {
+	src := fs.Open(f.name)
+	if src == nil {
+		return 0, errors.New("Could not open the file")
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(f.path), 0755); err != nil {
+		return 0, err
+	}
+
+	// A new file is created rather than writing through a link
+	if o.overwrite {
+		if err := os.Remove(f.path); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+	}
+
+	dst, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.Copy(dst, src)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return n, err
+	}
+
+	// The access time is left as it is
+	return n, os.Chtimes(f.path, time.Time{}, lastModified(fs, f, src))
+}
+
+// Returns when the file read through the handle was last modified.
+// If the name now belongs to another file the time it was listed
+// with is used.
+func lastModified(fs gofs.FileSystem, f fsFile, handle gofs.File) time.Time {
+	if stats := fs.Stat(f.name); stats != nil {
+		for _, h := range stats.Handles() {
+			if h == handle {
+				return stats.LastModified()
+			}
+		}
+	}
+	return f.modified
+}
@@ -0,0 +1,127 @@
+// Package hostdir copies files between a directory on the host and a
+// gofs.FileSystem.
+//
+// The name of a file in the file system is its path relative to the
+// directory, separated by slashes whatever the host uses.  Times are
+// kept when the file system is a gofs.TimeSetter.
+package hostdir
+
+import (
+	"path"
+)
+
+type options struct {
+	include        []string
+	exclude        []string
+	followSymlinks bool
+	overwrite      bool
+	skipExisting   bool
+	progress       func(Progress)
+}
+
+// Option changes how files are copied
+type Option func(*options)
+
+// Include only copies the files matching at least one of the
+// patterns.  Patterns use the syntax of path.Match and are matched
+// against both the name of a file and its last element, so "*.txt"
+// matches text files in every directory.
+func Include(patterns ...string) Option {
+	return func(o *options) {
+		o.include = append(o.include, patterns...)
+	}
+}
+
+// Exclude skips the files matching any of the patterns, which are
+// matched as they are by Include.  A directory on the host which
+// matches is skipped with everything below it.
+func Exclude(patterns ...string) Option {
+	return func(o *options) {
+		o.exclude = append(o.exclude, patterns...)
+	}
+}
+
+// FollowSymlinks makes Import copy the files and walk the directories
+// symbolic links on the host point at.  By default links are skipped.
+func FollowSymlinks() Option {
+	return func(o *options) {
+		o.followSymlinks = true
+	}
+}
+
+// Overwrite makes Export replace files which already exist on the
+// host.  By default Export fails when it finds one.
+func Overwrite() Option {
+	return func(o *options) {
+		o.overwrite, o.skipExisting = true, false
+	}
+}
+
+// SkipExisting makes Export leave files which already exist on the
+// host as they are
+func SkipExisting() Option {
+	return func(o *options) {
+		o.overwrite, o.skipExisting = false, true
+	}
+}
+
+// OnProgress calls fn after each file is copied
+func OnProgress(fn func(Progress)) Option {
+	return func(o *options) {
+		o.progress = fn
+	}
+}
+
+// Progress describes how far a copy has got
+type Progress struct {
+	Name       string // name of the file which was just copied
+	Files      int64  // number of files copied
+	TotalFiles int64  // number of files being copied
+	Bytes      int64  // number of bytes copied
+	TotalBytes int64  // number of bytes being copied
+}
+
+// Applies the options and checks the patterns are valid
+func newOptions(opts []Option) (*options, error) {
+	result := &options{}
+	for _, opt := range opts {
+		opt(result)
+	}
+
+	for _, pattern := range append(result.include, result.exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// Reports whether the name matches one of the patterns
+func matches(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		} else if ok, _ = path.Match(pattern, path.Base(name)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Reports whether the file with the name is copied
+func (o *options) wanted(name string) bool {
+	if matches(o.exclude, name) {
+		return false
+	}
+	return len(o.include) == 0 || matches(o.include, name)
+}
+
+// Reports progress after a file is copied
+func (o *options) report(progress *Progress, name string, bytes int64) {
+	progress.Name = name
+	progress.Files++
+	progress.Bytes += bytes
+	if o.progress != nil {
+		o.progress(*progress)
+	}
+}
@@ -0,0 +1,460 @@
+package hostdir
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/concrete"
+	"github.com/deathly809/gofs/memfs"
+	"github.com/deathly809/gofs/osfs"
+)
+
+// Whole seconds are kept by every host
+var testTime = time.Date(2001, time.February, 3, 4, 5, 6, 0, time.UTC)
+
+// Creates the files, named with slashes, under dir
+func writeTree(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		} else if err = os.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		} else if err = os.Chtimes(path, testTime, testTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Reads the whole file from the file system
+func readFile(t *testing.T, fs gofs.FileSystem, name string) string {
+	file := fs.Open(name)
+	if file == nil {
+		t.Fatalf("could not open %s", name)
+	}
+	defer file.Close()
+
+	data := make([]byte, file.Size()+1)
+	n, err := io.ReadFull(file, data)
+	if err != io.ErrUnexpectedEOF && err != io.EOF {
+		t.Fatal(err)
+	}
+	return string(data[:n])
+}
+
+// Checks which of the names exist in the file system
+func checkExists(t *testing.T, fs gofs.FileSystem, names map[string]bool) {
+	t.Helper()
+
+	for name, want := range names {
+		if fs.Exists(name) != want {
+			t.Errorf("%s: exists is %v, want %v", name, !want, want)
+		}
+	}
+}
+
+func TestImport(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.txt":           "first",
+		"sub/b.txt":       "second",
+		"sub/deeper/c.go": "third",
+		"empty":           "",
+	}
+	writeTree(t, dir, files)
+
+	fs := memfs.New()
+	if err := Import(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		if got := readFile(t, fs, name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		} else if modified := fs.Stat(name).LastModified(); !modified.Equal(testTime) {
+			t.Errorf("%s: last modified %v, want %v", name, modified, testTime)
+		}
+	}
+}
+
+func TestImport_Replace(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "short"})
+
+	fs := memfs.New()
+	file := fs.Open("a")
+	file.Write([]byte("a much longer file"))
+	file.Close()
+
+	if err := Import(fs, dir); err != nil {
+		t.Fatal(err)
+	} else if got := readFile(t, fs, "a"); got != "short" {
+		t.Errorf("got %q after replacing", got)
+	}
+}
+
+// Returns file systems which can rename files, one on the host and
+// one stored by concrete
+func renamingFS(t *testing.T) map[string]gofs.FileSystem {
+	host, err := osfs.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, err := concrete.Open(t.TempDir(), "import", concrete.InMemory())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := map[string]gofs.FileSystem{"osfs": host, "concrete": stored}
+	t.Cleanup(func() {
+		for _, fs := range result {
+			fs.Shutdown(context.Background())
+		}
+	})
+	return result
+}
+
+// A reader which fails after the first few bytes
+func failingReader(err error) io.Reader {
+	return io.MultiReader(strings.NewReader("partial"), iotest.ErrReader(err))
+}
+
+func TestImport_ReplaceFails(t *testing.T) {
+	errRead := errors.New("read failed")
+
+	for kind, fs := range renamingFS(t) {
+		file := fs.Open("a")
+		file.Write([]byte("original"))
+		file.Close()
+
+		if _, err := replace(fs, "a", failingReader(errRead)); err != errRead {
+			t.Errorf("%s: replace returned %v", kind, err)
+		}
+
+		if got := readFile(t, fs, "a"); got != "original" {
+			t.Errorf("%s: got %q after a failed replace", kind, got)
+		} else if names := fs.(gofs.Lister).Names(); len(names) != 1 {
+			t.Errorf("%s: files left behind: %v", kind, names)
+		}
+
+		if n, err := replace(fs, "a", strings.NewReader("new")); n != 3 || err != nil {
+			t.Errorf("%s: replace returned %d, %v", kind, n, err)
+		} else if got := readFile(t, fs, "a"); got != "new" {
+			t.Errorf("%s: got %q after replacing", kind, got)
+		} else if names := fs.(gofs.Lister).Names(); len(names) != 1 {
+			t.Errorf("%s: files left behind: %v", kind, names)
+		}
+	}
+
+	// Without a rename the file is written in place
+	fs := memfs.New()
+	file := fs.Open("a")
+	file.Write([]byte("original"))
+	file.Close()
+
+	if _, err := replace(fs, "a", failingReader(errRead)); err != errRead {
+		t.Errorf("replace returned %v", err)
+	} else if got := readFile(t, fs, "a"); got != "partial" {
+		t.Errorf("got %q after a failed replace", got)
+	}
+}
+
+// A file system which can neither rename nor delete files
+type stuckFS struct {
+	gofs.FileSystem
+}
+
+var errRename = errors.New("rename failed")
+var errDelete = errors.New("delete failed")
+
+func (stuckFS) Rename(oldName, newName string) error {
+	return errRename
+}
+
+func (stuckFS) Delete(name string) error {
+	return errDelete
+}
+
+func TestImport_ReplaceCleanup(t *testing.T) {
+	fs := stuckFS{memfs.New()}
+
+	_, err := replace(fs, "a", strings.NewReader("new"))
+	if !errors.Is(err, errRename) {
+		t.Fatalf("replace returned %v", err)
+	} else if !strings.Contains(err.Error(), errDelete.Error()) || !strings.Contains(err.Error(), "~import") {
+		t.Errorf("the temporary file is not reported: %v", err)
+	}
+}
+
+func TestImport_Patterns(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{
+		"a.txt":         "",
+		"a.go":          "",
+		"sub/b.txt":     "",
+		"sub/b_test.go": "",
+		"skip/c.txt":    "",
+	})
+
+	fs := memfs.New()
+	err := Import(fs, dir, Include("*.txt", "sub/*.go"), Exclude("skip", "*_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkExists(t, fs, map[string]bool{
+		"a.txt":         true,
+		"a.go":          false,
+		"sub/b.txt":     true,
+		"sub/b_test.go": false,
+		"skip/c.txt":    false,
+	})
+
+	if err = Import(memfs.New(), dir, Include("[")); err == nil {
+		t.Error("imported with a bad pattern")
+	}
+}
+
+func TestImport_Symlinks(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"sub/a": "linked"})
+
+	if err := os.Symlink("sub/a", filepath.Join(dir, "file")); err != nil {
+		t.Skip("cannot create symbolic links: ", err)
+	}
+	os.Symlink("sub", filepath.Join(dir, "dir"))
+	os.Symlink("..", filepath.Join(dir, "sub", "loop"))
+
+	fs := memfs.New()
+	if err := Import(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+	checkExists(t, fs, map[string]bool{"sub/a": true, "file": false, "dir/a": false})
+
+	fs = memfs.New()
+	if err := Import(fs, dir, FollowSymlinks()); err != nil {
+		t.Fatal(err)
+	}
+	checkExists(t, fs, map[string]bool{"sub/a": true, "file": true, "dir/a": true})
+
+	// Links back to a directory being walked are not followed
+	if fs.Exists("sub/loop/sub/a") {
+		t.Error("followed a link which loops")
+	}
+	if got := readFile(t, fs, "file"); got != "linked" {
+		t.Errorf("got %q through a link", got)
+	}
+}
+
+func TestImport_Progress(t *testing.T) {
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"a": "12345", "b/c": "123"})
+
+	var reports []Progress
+	err := Import(memfs.New(), dir, OnProgress(func(p Progress) {
+		reports = append(reports, p)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []Progress{
+		{Name: "a", Files: 1, TotalFiles: 2, Bytes: 5, TotalBytes: 8},
+		{Name: "b/c", Files: 2, TotalFiles: 2, Bytes: 8, TotalBytes: 8},
+	}
+	if len(reports) != len(want) {
+		t.Fatalf("%d reports, want %d", len(reports), len(want))
+	}
+	for i := range want {
+		if reports[i] != want[i] {
+			t.Errorf("report %d is %+v, want %+v", i, reports[i], want[i])
+		}
+	}
+}
+
+// Returns a file system holding the files, all last modified at
+// testTime
+func newTestFS(t *testing.T, files map[string]string) gofs.FileSystem {
+	fs := memfs.New()
+	for name, contents := range files {
+		file := fs.Open(name)
+		file.Write([]byte(contents))
+		file.Close()
+
+		if err := fs.(gofs.TimeSetter).SetLastModified(name, testTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return fs
+}
+
+// Checks the files on the host under dir, nil contents meaning the
+// file should not exist
+func checkHost(t *testing.T, dir string, files map[string]*string) {
+	t.Helper()
+
+	for name, want := range files {
+		path := filepath.Join(dir, filepath.FromSlash(name))
+		data, err := os.ReadFile(path)
+		if want == nil {
+			if err == nil {
+				t.Errorf("%s exists", name)
+			}
+			continue
+		} else if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+
+		if string(data) != *want {
+			t.Errorf("%s: got %q, want %q", name, data, *want)
+		}
+	}
+}
+
+func contents(s string) *string {
+	return &s
+}
+
+func TestExport(t *testing.T) {
+	files := map[string]string{
+		"a.txt":           "first",
+		"sub/b.txt":       "second",
+		"sub/deeper/c.go": "third",
+		"empty":           "",
+	}
+
+	dir := t.TempDir()
+	if err := Export(newTestFS(t, files), dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range files {
+		checkHost(t, dir, map[string]*string{name: contents(want)})
+
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			t.Fatal(err)
+		} else if !info.ModTime().Equal(testTime) {
+			t.Errorf("%s: last modified %v, want %v", name, info.ModTime(), testTime)
+		}
+	}
+
+	// What was exported imports back the same
+	fs := memfs.New()
+	if err := Import(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+	for name, want := range files {
+		if got := readFile(t, fs, name); got != want {
+			t.Errorf("%s: got %q back, want %q", name, got, want)
+		}
+	}
+}
+
+// A file system whose files change between being listed and opened
+type changingFS struct {
+	gofs.FileSystem
+	changes map[string]string
+}
+
+func (fs *changingFS) Names() []string {
+	return fs.FileSystem.(gofs.Lister).Names()
+}
+
+func (fs *changingFS) Open(name string) gofs.File {
+	if contents, exists := fs.changes[name]; exists {
+		fs.FileSystem.Delete(name)
+		file := fs.FileSystem.Open(name)
+		file.Write([]byte(contents))
+		file.Close()
+		fs.FileSystem.(gofs.TimeSetter).SetLastModified(name, changedTime)
+	}
+	return fs.FileSystem.Open(name)
+}
+
+var changedTime = testTime.Add(time.Hour)
+
+func TestExport_Changed(t *testing.T) {
+	changes := map[string]string{"grown": "a longer file", "shrunk": "b"}
+	fs := &changingFS{newTestFS(t, map[string]string{"grown": "a", "shrunk": "a longer file"}), changes}
+
+	dir := t.TempDir()
+	if err := Export(fs, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, want := range changes {
+		checkHost(t, dir, map[string]*string{name: contents(want)})
+
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		} else if !info.ModTime().Equal(changedTime) {
+			t.Errorf("%s: last modified %v, want %v", name, info.ModTime(), changedTime)
+		}
+	}
+}
+
+func TestExport_Existing(t *testing.T) {
+	fs := newTestFS(t, map[string]string{"a": "new", "b": "new"})
+
+	dir := t.TempDir()
+	writeTree(t, dir, map[string]string{"b": "old"})
+
+	if err := Export(fs, dir); !errors.Is(err, os.ErrExist) {
+		t.Errorf("exported over an existing file: %v", err)
+	}
+	checkHost(t, dir, map[string]*string{"a": nil, "b": contents("old")})
+
+	if err := Export(fs, dir, SkipExisting()); err != nil {
+		t.Fatal(err)
+	}
+	checkHost(t, dir, map[string]*string{"a": contents("new"), "b": contents("old")})
+
+	if err := Export(fs, dir, Overwrite()); err != nil {
+		t.Fatal(err)
+	}
+	checkHost(t, dir, map[string]*string{"a": contents("new"), "b": contents("new")})
+}
+
+func TestExport_Patterns(t *testing.T) {
+	fs := newTestFS(t, map[string]string{
+		"a.txt":         "a",
+		"a.go":          "a",
+		"sub/b.txt":     "b",
+		"sub/b_test.go": "b",
+	})
+
+	dir := t.TempDir()
+	if err := Export(fs, dir, Include("*.txt", "sub/*.go"), Exclude("*_test.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	checkHost(t, dir, map[string]*string{
+		"a.txt":         contents("a"),
+		"a.go":          nil,
+		"sub/b.txt":     contents("b"),
+		"sub/b_test.go": nil,
+	})
+}
+
+func TestExport_Names(t *testing.T) {
+	for _, name := range []string{"../escape", "/absolute", "a/../../escape"} {
+		fs := newTestFS(t, map[string]string{name: "data"})
+
+		dir := filepath.Join(t.TempDir(), "inner")
+		if err := Export(fs, dir); err == nil {
+			t.Errorf("exported %s", name)
+		}
+		checkHost(t, filepath.Dir(dir), map[string]*string{"escape": nil, "absolute": nil})
+	}
+}
@@ -0,0 +1,189 @@
+package hostdir
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+
+	"github.com/deathly809/gofs"
+)
+
+// A file on the host to copy in
+type hostFile struct {
+	name     string // name in the file system
+	path     string // path on the host
+	size     int64
+	modified time.Time
+}
+
+// Import copies the files in the directory on the host, and in every
+// directory below it, into the file system.  Files which already
+// exist in the file system are replaced.
+//
+// Only regular files are copied.  The first error stops the copy,
+// files copied before it are left in the file system.  A file being
+// replaced is kept if the file system is a gofs.Renamer, otherwise
+// an error while its new contents are copied loses it.  A crash while
+// copying into a gofs.Renamer can leave a file named ~import, or
+// ~import followed by a number, behind.
+func Import(fs gofs.FileSystem, hostDir string, opts ...Option) error {
+	o, err := newOptions(opts)
+	if err != nil {
+		return err
+	}
+
+	root, err := filepath.EvalSymlinks(hostDir)
+	if err != nil {
+		return err
+	}
+
+	var files []hostFile
+	walking := map[string]bool{root: true}
+	if files, err = o.scan(hostDir, "", walking, files); err != nil {
+		return err
+	}
+
+	progress := Progress{TotalFiles: int64(len(files))}
+	for _, f := range files {
+		progress.TotalBytes += f.size
+	}
+
+	for _, f := range files {
+		n, err := importFile(fs, f)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.name, err)
+		}
+		o.report(&progress, f.name, n)
+	}
+	return nil
+}
+
+// Adds the files wanted in the directory, and those below it, to
+// files.  Links to a directory which is being walked are skipped so
+// they cannot make the walk loop.
+func (o *options) scan(dir, prefix string, walking map[string]bool, files []hostFile) ([]hostFile, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return files, err
+	}
+
+	for _, entry := range entries {
+		name := path.Join(prefix, entry.Name())
+		full := filepath.Join(dir, entry.Name())
+
+		info, err := entry.Info()
+		if err != nil {
+			return files, err
+		}
+
+		if info.Mode()&os.ModeSymlink != 0 {
+			if !o.followSymlinks {
+				continue
+			} else if info, err = os.Stat(full); err != nil {
+				return files, err
+			}
+		}
+
+		switch {
+		case info.IsDir():
+			if matches(o.exclude, name) {
+				continue
+			}
+
+			real, err := filepath.EvalSymlinks(full)
+			if err != nil {
+				return files, err
+			} else if walking[real] {
+				continue
+			}
+
+			walking[real] = true
+			files, err = o.scan(full, name, walking, files)
+			delete(walking, real)
+			if err != nil {
+				return files, err
+			}
+
+		case info.Mode().IsRegular() && o.wanted(name):
+			files = append(files, hostFile{
+				name:     name,
+				path:     full,
+				size:     info.Size(),
+				modified: info.ModTime(),
+			})
+		}
+	}
+	return files, nil
+}
+
+// Copies a file from the host into the file system and returns how
+// many bytes were copied
+func importFile(fs gofs.FileSystem, f hostFile) (int64, error) {
+	src, err := os.Open(f.path)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	n, err := replace(fs, f.name, src)
+	if err != nil {
+		return n, err
+	}
+
+	if setter, ok := fs.(gofs.TimeSetter); ok {
+		err = setter.SetLastModified(f.name, f.modified)
+	}
+	return n, err
+}
+
+// Replaces the contents of the file with everything read from src.
+// A file system which is a gofs.Renamer has them copied under a
+// temporary name which is then renamed over the file, so an error
+// leaves the file as it was.  Any other file system has the file
+// deleted and copied again in place, which is not atomic: an error
+// part way loses the old contents and leaves part of the new.
+func replace(fs gofs.FileSystem, name string, src io.Reader) (int64, error) {
+	renamer, ok := fs.(gofs.Renamer)
+	if !ok {
+		// Writing over a longer file would leave its end behind
+		if err := fs.Delete(name); err != nil {
+			return 0, err
+		}
+		return copyTo(fs, name, src)
+	}
+
+	temp := "~import"
+	for i := 1; fs.Exists(temp); i++ {
+		temp = fmt.Sprintf("~import%d", i)
+	}
+
+	n, err := copyTo(fs, temp, src)
+	if err == nil {
+		err = renamer.Rename(temp, name)
+	}
+
+	if err != nil && fs.Exists(temp) {
+		if e := fs.Delete(temp); e != nil {
+			return n, fmt.Errorf("%w, and deleting %s failed: %v", err, temp, e)
+		}
+	}
+	return n, err
+}
+
+// Writes everything read from src to a new file with the name
+func copyTo(fs gofs.FileSystem, name string, src io.Reader) (int64, error) {
+	dst := fs.Open(name)
+	if dst == nil {
+		return 0, errors.New("Could not open the file")
+	}
+
+	n, err := io.Copy(dst, src)
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	return n, err
+}
@@ -0,0 +1,202 @@
+// Package fsutil holds the bookkeeping shared by the FileSystems in
+// this module.
+//
+// A State tracks whether a FileSystem is open, which handle holds
+// the lock on each file, the reads and writes in progress and the
+// guards of the safe readers and writers.  It is guarded by the lock
+// of the FileSystem it belongs to, so the FileSystem can change its
+// own metadata in the same critical section.
+package fsutil
+
+import (
+	"context"
+	"io"
+	"sync"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/readers"
+)
+
+// The states of a FileSystem or of a handle
+const (
+	Open = iota
+	Closed
+	Closing
+)
+
+// State is the bookkeeping of a single FileSystem.  Unless noted the
+// methods must be called with its lock held.
+type State struct {
+	Status   int                       // open, closing or closed
+	lock     *sync.Mutex               // the lock of the FileSystem
+	cond     *sync.Cond                // signalled when a lock is released or I/O finishes
+	inFlight int                       // reads and writes in progress
+	locked   map[string]gofs.File      // the handle holding the lock of each locked file
+	guards   map[string]*readers.Guard // coordinates the safe readers and writers of each file
+}
+
+// NewState returns the State of an open FileSystem guarded by the lock
+func NewState(lock *sync.Mutex) *State {
+	return &State{
+		Status: Open,
+		lock:   lock,
+		cond:   sync.NewCond(lock),
+		locked: make(map[string]gofs.File),
+		guards: make(map[string]*readers.Guard),
+	}
+}
+
+// IsClosed takes the lock and returns whether the FileSystem is closed
+func (s *State) IsClosed() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.Status == Closed
+}
+
+// Returns the guard shared by the safe readers and writers of a file
+func (s *State) guardFor(filename string) *readers.Guard {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	guard, exists := s.guards[filename]
+	if !exists {
+		guard = readers.NewGuard()
+		s.guards[filename] = guard
+	}
+	return guard
+}
+
+// SafeWriter takes the lock and returns a writer coordinated with
+// the other safe readers and writers of the file, or nil if the
+// FileSystem is closed
+func (s *State) SafeWriter(file gofs.File) io.Writer {
+	if file == nil || s.IsClosed() {
+		return nil
+	}
+	return readers.NewSafeWriter(file, s.guardFor(file.Name()))
+}
+
+// SafeReader takes the lock and returns a reader coordinated with
+// the other safe readers and writers of the file, or nil if the
+// FileSystem is closed
+func (s *State) SafeReader(file gofs.File) io.Reader {
+	if file == nil || s.IsClosed() {
+		return nil
+	}
+	return readers.NewSafeReader(file, s.guardFor(file.Name()))
+}
+
+// ReleaseGuard forgets the guard of a file which has no handle left
+func (s *State) ReleaseGuard(filename string) {
+	delete(s.guards, filename)
+}
+
+// Guards returns the number of files with a guard
+func (s *State) Guards() int {
+	return len(s.guards)
+}
+
+// BeginIO waits until the file may be read or written by the handle
+// and records the I/O as in progress.  It must be followed by a call
+// to EndIO.
+func (s *State) BeginIO(handle gofs.File) error {
+	for s.Status != Closed {
+		owner, locked := s.locked[handle.Name()]
+		if !locked || owner == handle {
+			s.inFlight++
+			return nil
+		}
+		s.cond.Wait()
+	}
+	return gofs.ErrClosed
+}
+
+// EndIO records that I/O started by BeginIO has finished
+func (s *State) EndIO() {
+	s.inFlight--
+	s.cond.Broadcast()
+}
+
+// InFlight returns the number of reads and writes in progress
+func (s *State) InFlight() int {
+	return s.inFlight
+}
+
+// Lock waits until no other handle holds the lock on the file and
+// gives it to the handle.  It returns false if the handle already
+// held it or the FileSystem stopped being open first.
+func (s *State) Lock(file gofs.File) bool {
+	for s.Status == Open {
+		owner, locked := s.locked[file.Name()]
+		if !locked {
+			s.locked[file.Name()] = file
+			return true
+		} else if owner == file {
+			return false
+		}
+		s.cond.Wait()
+	}
+	return false
+}
+
+// Unlock releases the lock on the file if it is held by the handle
+// and returns whether it was
+func (s *State) Unlock(file gofs.File) bool {
+	if owner, locked := s.locked[file.Name()]; locked && owner == file {
+		delete(s.locked, file.Name())
+		s.cond.Broadcast()
+		return true
+	}
+	return false
+}
+
+// Owner returns the handle holding the lock on the file, if any
+func (s *State) Owner(filename string) (gofs.File, bool) {
+	owner, locked := s.locked[filename]
+	return owner, locked
+}
+
+// Shutdown marks the FileSystem as closing and waits until no I/O is
+// in progress and no file is locked, or until the context expires.
+// It then calls release to free the resources of the FileSystem and
+// closes the State.  The first error of the context and release is
+// returned.
+func (s *State) Shutdown(ctx context.Context, release func() error) error {
+	if s.Status != Open {
+		return gofs.ErrClosed
+	}
+	s.Status = Closing
+
+	// Wake up the wait below if the context expires
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.lock.Lock()
+			s.cond.Broadcast()
+			s.lock.Unlock()
+		case <-done:
+		}
+	}()
+
+	for (s.inFlight > 0 || len(s.locked) > 0) && ctx.Err() == nil {
+		s.cond.Wait()
+	}
+
+	err := ctx.Err()
+	if e := release(); err == nil {
+		err = e
+	}
+
+	s.Close()
+	return err
+}
+
+// Close marks the FileSystem closed without waiting, dropping any
+// locks still held and waking everything waiting on them
+func (s *State) Close() {
+	s.Status = Closed
+	s.locked = make(map[string]gofs.File)
+	s.cond.Broadcast()
+}
@@ -0,0 +1,41 @@
+package fsutil
+
+import (
+	"time"
+
+	"github.com/deathly809/gofs"
+)
+
+// Information about a file at the time Stat was called
+type fileStats struct {
+	created      time.Time
+	lastModified time.Time
+	size         int64
+	handles      []gofs.File
+}
+
+// NewFileStats returns the gofs.FileStats of a file
+func NewFileStats(created, lastModified time.Time, size int64, handles []gofs.File) gofs.FileStats {
+	return &fileStats{
+		created:      created,
+		lastModified: lastModified,
+		size:         size,
+		handles:      handles,
+	}
+}
+
+func (stats *fileStats) Created() time.Time {
+	return stats.created
+}
+
+func (stats *fileStats) LastModified() time.Time {
+	return stats.lastModified
+}
+
+func (stats *fileStats) Size() int {
+	return int(stats.size)
+}
+
+func (stats *fileStats) Handles() []gofs.File {
+	return stats.handles
+}
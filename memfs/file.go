@@ -0,0 +1,139 @@
+package memfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
+	"github.com/deathly809/gomath"
+)
+
+// An open handle to a file
+type file struct {
+	fs     *fileSystemImpl
+	data   *fileData
+	pos    int64
+	isnew  bool
+	status int
+}
+
+func (f *file) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return errors.New("File already closed")
+	}
+	f.status = fsutil.Closed
+
+	if f.fs.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+	f.fs.state.Unlock(f)
+	f.fs.closeHandle(f)
+
+	return nil
+}
+
+func (f *file) Write(data []byte) (bytesWritten int, err error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return 0, errors.New("Cannot write to a closed file")
+	} else if data == nil {
+		return 0, errors.New("Null pointer exception")
+	} else if err = f.fs.state.BeginIO(f); err != nil {
+		return 0, err
+	}
+	defer f.fs.state.EndIO()
+
+	finalPos := f.pos + int64(len(data))
+	if finalPos > int64(cap(f.data.data)) {
+		grown := make([]byte, finalPos, 2*finalPos)
+		copy(grown, f.data.data)
+		f.data.data = grown
+	} else if finalPos > int64(len(f.data.data)) {
+		f.data.data = f.data.data[:finalPos]
+	}
+
+	bytesWritten = copy(f.data.data[f.pos:], data)
+	f.pos = finalPos
+	f.data.lastModified = time.Now()
+
+	return bytesWritten, nil
+}
+
+// Read data into a given byte array
+// If the array is null an error is returned
+func (f *file) Read(data []byte) (bytesRead int, err error) {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return 0, errors.New("Cannot read from a closed file")
+	} else if data == nil {
+		return 0, errors.New("Null pointer exception")
+	} else if err = f.fs.state.BeginIO(f); err != nil {
+		return 0, err
+	}
+	defer f.fs.state.EndIO()
+
+	if len(data) > 0 && f.pos >= int64(len(f.data.data)) {
+		return 0, io.EOF
+	}
+
+	bytesRead = copy(data, f.data.data[f.pos:])
+	f.pos += int64(bytesRead)
+
+	return bytesRead, nil
+}
+
+// Seek will move to a specific spot in the file.  If the
+// spot is not within the file it is clamped to either the
+// beginning or the end of the file.
+func (f *file) Seek(offset int64, from int) (int64, error) {
+	var base int64
+
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return 0, errors.New("Cannot seek in a closed file")
+	} else if f.fs.state.Status == fsutil.Closed {
+		return 0, gofs.ErrClosed
+	}
+
+	size := int64(len(f.data.data))
+	switch gofs.FileOffset(from) {
+	case gofs.Beginning:
+		base = 0
+	case gofs.Current:
+		base = f.pos
+	case gofs.End:
+		base = size
+	default:
+		return f.pos, fmt.Errorf("invalid seek origin: %d", from)
+	}
+
+	f.pos = gomath.MaxInt64(0, gomath.MinInt64(base+offset, size))
+	return f.pos, nil
+}
+
+func (f *file) IsNew() bool {
+	return f.isnew
+}
+
+func (f *file) Name() string {
+	return f.data.name
+}
+
+func (f *file) Size() int64 {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	return int64(len(f.data.data))
+}
@@ -0,0 +1,223 @@
+// Package memfs contains a gofs.FileSystem kept entirely in memory.
+//
+// Each file is a byte slice in a map.  Nothing is ever written to
+// disk so everything is lost when the file system is shut down.  It
+// is meant for tests and as the simplest implementation of the
+// gofs.FileSystem contract.
+package memfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
+)
+
+// The contents of a file
+type fileData struct {
+	name         string
+	data         []byte
+	created      time.Time
+	lastModified time.Time
+}
+
+type fileSystemImpl struct {
+	files     map[string]*fileData  // the files in the file system
+	openFiles map[*fileData][]*file // the open handles of each file
+	state     *fsutil.State         // locks, I/O in progress and safe readers and writers
+	lock      *sync.Mutex           // guards everything above and the contents of the files
+}
+
+// New creates an empty file system
+func New() gofs.FileSystem {
+	result := &fileSystemImpl{
+		files:     make(map[string]*fileData),
+		openFiles: make(map[*fileData][]*file),
+		lock:      &sync.Mutex{},
+	}
+	result.state = fsutil.NewState(result.lock)
+	return result
+}
+
+func (fSys *fileSystemImpl) GetSafeWriter(file gofs.File) io.Writer {
+	return fSys.state.SafeWriter(file)
+}
+
+func (fSys *fileSystemImpl) GetSafeReader(file gofs.File) io.Reader {
+	return fSys.state.SafeReader(file)
+}
+
+func (fSys *fileSystemImpl) Shutdown(ctx context.Context) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	return fSys.state.Shutdown(ctx, func() error {
+		fSys.files = make(map[string]*fileData)
+		return nil
+	})
+}
+
+func (fSys *fileSystemImpl) Lock(file gofs.File) {
+	if file == nil {
+		return
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	fSys.state.Lock(file)
+}
+
+func (fSys *fileSystemImpl) Unlock(file gofs.File) {
+	if file == nil {
+		return
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	fSys.state.Unlock(file)
+}
+
+func (fSys *fileSystemImpl) Open(filename string) gofs.File {
+	if len(filename) == 0 {
+		return nil
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status != fsutil.Open {
+		return nil
+	}
+
+	data, exists := fSys.files[filename]
+	if !exists {
+		now := time.Now()
+		data = &fileData{
+			name:         filename,
+			created:      now,
+			lastModified: now,
+		}
+		fSys.files[filename] = data
+	}
+
+	handle := &file{
+		fs:     fSys,
+		data:   data,
+		isnew:  !exists,
+		status: fsutil.Open,
+	}
+	fSys.openFiles[data] = append(fSys.openFiles[data], handle)
+
+	return handle
+}
+
+// Removes the handle from the open file table
+func (fSys *fileSystemImpl) closeHandle(handle *file) {
+	handles := fSys.openFiles[handle.data]
+	for i, h := range handles {
+		if h == handle {
+			handles = append(handles[:i], handles[i+1:]...)
+			break
+		}
+	}
+
+	if len(handles) > 0 {
+		fSys.openFiles[handle.data] = handles
+	} else {
+		delete(fSys.openFiles, handle.data)
+	}
+
+	// Safe readers and writers of the name have no handle left to use
+	if !fSys.inUse(handle.data.name) {
+		fSys.state.ReleaseGuard(handle.data.name)
+	}
+}
+
+// Returns whether a handle is open on a file with the name, even one
+// which has since been deleted
+func (fSys *fileSystemImpl) inUse(filename string) bool {
+	for data := range fSys.openFiles {
+		if data.name == filename {
+			return true
+		}
+	}
+	return false
+}
+
+func (fSys *fileSystemImpl) Exists(filename string) bool {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	_, exists := fSys.files[filename]
+	return exists && fSys.state.Status != fsutil.Closed
+}
+
+// Delete removes the name of the file.  Open handles keep the
+// contents, which are released once the last of them is closed.
+func (fSys *fileSystemImpl) Delete(filename string) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+
+	delete(fSys.files, filename)
+	return nil
+}
+
+func (fSys *fileSystemImpl) Stat(filename string) gofs.FileStats {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	data, exists := fSys.files[filename]
+	if !exists || fSys.state.Status == fsutil.Closed {
+		return nil
+	}
+
+	handles := make([]gofs.File, 0, len(fSys.openFiles[data]))
+	for _, handle := range fSys.openFiles[data] {
+		handles = append(handles, handle)
+	}
+
+	return fsutil.NewFileStats(data.created, data.lastModified, int64(len(data.data)), handles)
+}
+
+func (fSys *fileSystemImpl) Names() []string {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return nil
+	}
+
+	names := make([]string, 0, len(fSys.files))
+	for name := range fSys.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (fSys *fileSystemImpl) SetLastModified(filename string, t time.Time) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+
+	data, exists := fSys.files[filename]
+	if !exists {
+		return fmt.Errorf("file does not exist: %s", filename)
+	}
+	data.lastModified = t
+	return nil
+}
@@ -0,0 +1,204 @@
+package memfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/fstest"
+)
+
+var testData = []byte("asdfgasdfgasdfgasdfgasdfgasdfg")
+
+func TestReadWrite(t *testing.T) {
+	fs := New()
+	defer fs.Shutdown(context.Background())
+
+	file := fs.Open("test")
+	if file == nil || !file.IsNew() {
+		t.Fatal("could not create file")
+	}
+
+	if n, err := file.Write(testData); n != len(testData) || err != nil {
+		t.Error("did not write all data: ", err)
+	}
+
+	if file.Size() != int64(len(testData)) || fs.Stat("test").Size() != len(testData) {
+		t.Error("incorrect size: ", file.Size())
+	}
+
+	if _, err := file.Seek(0, int(gofs.Beginning)); err != nil {
+		t.Error(err)
+	}
+
+	data := make([]byte, len(testData))
+	if n, err := file.Read(data); n != len(data) || err != nil {
+		t.Error("did not read all data: ", err)
+	} else if !bytes.Equal(data, testData) {
+		t.Error("data not the same")
+	}
+
+	if _, err := file.Read(data); err != io.EOF {
+		t.Error("expected io.EOF at the end of the file: ", err)
+	}
+
+	if pos, _ := file.Seek(-10, int(gofs.Beginning)); pos != 0 {
+		t.Error("seek not clamped to the beginning: ", pos)
+	} else if pos, _ := file.Seek(10, int(gofs.End)); pos != int64(len(testData)) {
+		t.Error("seek not clamped to the end: ", pos)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Error(err)
+	} else if err := file.Close(); err == nil {
+		t.Error("closed a file twice")
+	}
+
+	other := fs.Open("test")
+	if other.IsNew() || other.Size() != int64(len(testData)) {
+		t.Error("file not kept after close")
+	}
+	other.Close()
+}
+
+func TestDelete(t *testing.T) {
+	fs := New()
+	defer fs.Shutdown(context.Background())
+
+	file := fs.Open("test")
+	file.Write(testData)
+
+	if err := fs.Delete("test"); err != nil {
+		t.Error(err)
+	}
+
+	if fs.Exists("test") || fs.Stat("test") != nil {
+		t.Error("file still exists after delete")
+	}
+
+	// Open handles keep the contents
+	data := make([]byte, len(testData))
+	file.Seek(0, int(gofs.Beginning))
+	if n, _ := file.Read(data); n != len(data) || !bytes.Equal(data, testData) {
+		t.Error("handle lost data after delete")
+	}
+	file.Close()
+
+	if again := fs.Open("test"); !again.IsNew() || again.Size() != 0 {
+		t.Error("deleted file was not replaced by an empty one")
+	}
+}
+
+func TestLock(t *testing.T) {
+	fs := New()
+	defer fs.Shutdown(context.Background())
+
+	owner := fs.Open("test")
+	other := fs.Open("test")
+
+	fs.Lock(owner)
+	if len(fs.Stat("test").Handles()) != 2 {
+		t.Error("incorrect number of handles")
+	}
+
+	written := make(chan struct{})
+	go func() {
+		other.Write(testData)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Error("wrote to a file locked by another handle")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Unlocking with the wrong handle does nothing
+	fs.Unlock(other)
+	select {
+	case <-written:
+		t.Error("lock released by a handle which does not hold it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fs.Unlock(owner)
+	<-written
+
+	owner.Close()
+	other.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	fs := New()
+	file := fs.Open("test")
+
+	fs.Lock(file)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := fs.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Error("shutdown did not wait for the lock: ", err)
+	}
+
+	if fs.Open("test") != nil || fs.Exists("test") {
+		t.Error("file system still usable after shutdown")
+	}
+
+	if _, err := file.Write(testData); err != gofs.ErrClosed {
+		t.Error("expected ErrClosed: ", err)
+	}
+
+	if err := fs.Shutdown(context.Background()); err != gofs.ErrClosed {
+		t.Error("shut down twice")
+	}
+}
+
+func TestSafeReaderWriter(t *testing.T) {
+	fs := New()
+	defer fs.Shutdown(context.Background())
+
+	file := fs.Open("test")
+	defer file.Close()
+
+	if n, err := fs.GetSafeWriter(file).Write(testData); n != len(testData) || err != nil {
+		t.Error("safe writer did not write all data: ", err)
+	}
+
+	file.Seek(0, int(gofs.Beginning))
+	data := make([]byte, len(testData))
+	if n, err := fs.GetSafeReader(file).Read(data); n != len(data) || err != nil {
+		t.Error("safe reader did not read all data: ", err)
+	} else if !bytes.Equal(data, testData) {
+		t.Error("data not the same")
+	}
+}
+
+func TestSafeGuards(t *testing.T) {
+	fs := New()
+	defer fs.Shutdown(context.Background())
+
+	file := fs.Open("test")
+	fs.GetSafeWriter(file)
+	if err := fs.Delete("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kept while a handle on the name is open, even a deleted one
+	again := fs.Open("test")
+	fs.GetSafeReader(again)
+	again.Close()
+	if guards := fs.(*fileSystemImpl).state.Guards(); guards != 1 {
+		t.Errorf("%d guards while a handle is open", guards)
+	}
+
+	file.Close()
+	if guards := fs.(*fileSystemImpl).state.Guards(); guards != 0 {
+		t.Errorf("%d guards after the last handle was closed", guards)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fstest.TestFileSystem(t, New)
+}
@@ -0,0 +1,120 @@
+package mmap
+
+import (
+	"errors"
+	"os"
+
+	"github.com/deathly809/gomath"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// Advice tells the operating system how a part of the file will be
+// used so it can choose what to read ahead and what to keep
+type Advice int
+
+const (
+	// AdviseNormal undoes any earlier advice
+	AdviseNormal Advice = iota
+	// AdviseSequential expects the pages to be read in order
+	AdviseSequential
+	// AdviseRandom expects the pages to be read in no order
+	AdviseRandom
+	// AdviseWillNeed expects the pages to be read soon
+	AdviseWillNeed
+	// AdviseDontNeed expects the pages not to be read soon
+	AdviseDontNeed
+)
+
+// ErrUnsupported is returned for hints the operating system does
+// not support
+var ErrUnsupported = errors.New("mmap: not supported on this platform")
+
+// What was asked of a range of the file, kept so it can be asked
+// again whenever the range is mapped again
+type hint struct {
+	offset int64 // from the start of the file, header included
+	length int64
+	lock   bool // a lock or unlock rather than advice
+	value  int  // the advice, or 1 to lock and 0 to unlock
+}
+
+func (mFile *mmapFileImpl) Advise(offset, length int64, advice Advice) error {
+	if advice < AdviseNormal || advice > AdviseDontNeed {
+		return errors.New("Unknown advice")
+	}
+	return mFile.addHint(offset, length, false, int(advice))
+}
+
+func (mFile *mmapFileImpl) LockPages(offset, length int64) error {
+	return mFile.addHint(offset, length, true, 1)
+}
+
+func (mFile *mmapFileImpl) UnlockPages(offset, length int64) error {
+	return mFile.addHint(offset, length, true, 0)
+}
+
+// Applies the hint to the memory mapped now and records it,
+// replacing any of the same kind for the same range
+func (mFile *mmapFileImpl) addHint(offset, length int64, lock bool, value int) error {
+	if offset < 0 || length < 0 {
+		return errors.New("Cannot hint a negative range")
+	}
+
+	mFile.lock.Lock()
+	defer mFile.lock.Unlock()
+
+	if mFile.closed {
+		return ErrClosed
+	} else if mFile.memory {
+		return nil
+	}
+
+	h := hint{offset: _HeaderSize + offset, length: length, lock: lock, value: value}
+
+	if mFile.windows == nil {
+		if err := applyHint(mFile.memmap, 0, h); err != nil {
+			return err
+		}
+	} else {
+		for elem := mFile.windows.lru.Front(); elem != nil; elem = elem.Next() {
+			w := elem.Value.(*window)
+			if err := applyHint(w.data, w.index*mFile.windows.size, h); err != nil {
+				return err
+			}
+		}
+	}
+
+	kept := mFile.hints[:0]
+	for _, old := range mFile.hints {
+		if old.offset != h.offset || old.length != h.length || old.lock != h.lock {
+			kept = append(kept, old)
+		}
+	}
+	mFile.hints = append(kept, h)
+
+	return nil
+}
+
+// Applies every recorded hint to memory which was just mapped,
+// base is where the memory starts in the file.  Hints are only
+// hints so failures are ignored.
+func (mFile *mmapFileImpl) applyHints(data mmap.MMap, base int64) {
+	for _, h := range mFile.hints {
+		applyHint(data, base, h)
+	}
+}
+
+// Applies the hint to the part of data it covers.  The start of the
+// range is moved back to a page boundary as the operating system
+// requires.
+func applyHint(data mmap.MMap, base int64, h hint) error {
+	start := gomath.MaxInt64(h.offset-base, 0)
+	end := gomath.MinInt64(h.offset+h.length-base, int64(len(data)))
+	if start >= end {
+		return nil
+	}
+
+	start -= start % int64(os.Getpagesize())
+	return hintPages(data[start:end], h)
+}
@@ -0,0 +1,8 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !openbsd && !solaris && !netbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!openbsd,!solaris,!netbsd
+
+package mmap
+
+func hintPages(pages []byte, h hint) error {
+	return ErrUnsupported
+}
@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || linux || openbsd || solaris || netbsd
+// +build darwin dragonfly freebsd linux openbsd solaris netbsd
+
+package mmap
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+var advice = map[int]int{
+	int(AdviseNormal):     unix.MADV_NORMAL,
+	int(AdviseSequential): unix.MADV_SEQUENTIAL,
+	int(AdviseRandom):     unix.MADV_RANDOM,
+	int(AdviseWillNeed):   unix.MADV_WILLNEED,
+	int(AdviseDontNeed):   unix.MADV_DONTNEED,
+}
+
+func hintPages(pages []byte, h hint) error {
+	if !h.lock {
+		return unix.Madvise(pages, advice[h.value])
+	} else if h.value == 1 {
+		return unix.Mlock(pages)
+	}
+	return unix.Munlock(pages)
+}
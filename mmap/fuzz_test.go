@@ -0,0 +1,57 @@
+package mmap
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/deathly809/gofs"
+)
+
+// Opens the image read-only, windowed and for writing, reading and
+// writing whatever was loaded.  Damaged images must return errors,
+// not panic.
+func FuzzNewFile(f *testing.F) {
+	dir := f.TempDir()
+
+	seedPath := filepath.Join(dir, "seed")
+	file, err := NewFile(seedPath)
+	if err != nil {
+		f.Fatal(err)
+	}
+	file.Write(testData)
+	file.Close()
+
+	seed, _ := os.ReadFile(seedPath)
+	f.Add(seed)
+	f.Add(seed[:_HeaderSize])
+	f.Add(seed[:_LegacyHeaderSize])
+	for _, ver := range []byte{1, 2} {
+		writeLegacyFile(seedPath, ver, testData)
+		legacy, _ := os.ReadFile(seedPath)
+		f.Add(legacy)
+	}
+
+	pageSize := int64(os.Getpagesize())
+	options := [][]Option{{ReadOnly()}, {Windowed(pageSize, 1)}, nil}
+
+	f.Fuzz(func(t *testing.T, image []byte) {
+		path := filepath.Join(t.TempDir(), "fuzz")
+
+		for _, opts := range options {
+			if err := os.WriteFile(path, image, 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			file, err := NewFile(path, opts...)
+			if err != nil {
+				continue
+			}
+
+			file.Read(make([]byte, 2*pageSize))
+			file.Seek(0, int(gofs.End))
+			file.Write(testData)
+			file.Close()
+		}
+	})
+}
@@ -0,0 +1,261 @@
+package mmap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"unsafe"
+
+	"github.com/deathly809/gomath"
+)
+
+// The header layout is
+//
+// sanity		= 15 bytes
+// version		= 1 byte
+// size		= 8 bytes, bytes written after the header
+// checksum	= 4 bytes, CRC-32 of the fields before it
+// state		= 4 bytes, _Migrating while the data is moved into place
+//
+// Versions 1 and 2 had no checksum and a 25 byte header.  Version 1
+// stored the size of the whole file rather than what was written.
+const (
+	_FieldsSize = 15 + 1 + 8
+	_HeaderSize = int64(_FieldsSize + 4 + 4)
+
+	_LegacyHeaderSize = int64(unsafe.Sizeof(_Version)+unsafe.Sizeof(1)) + 16
+
+	_Migrating = uint32(0x6d696772)
+)
+
+type header struct {
+	sanity    []byte
+	ver       byte
+	mSize     int64
+	checksum  uint32
+	valid     bool // the checksum matched, always true before version 3
+	migrating bool // the data is still being moved after the header grew
+}
+
+// A migration upgrades a file from the version in the header to the
+// next one and returns the header as the new version reads it
+type migration func(mFile *mmapFileImpl, h header) (header, error)
+
+// The migrations by the version they upgrade from
+var migrations = map[byte]migration{
+	1: migrateSizeOfData,
+	2: migrateChecksum,
+}
+
+// Version 2 stores the size of what was written instead of the size
+// of the whole file
+func migrateSizeOfData(mFile *mmapFileImpl, h header) (header, error) {
+	h.ver = 2
+	h.mSize -= _LegacyHeaderSize
+	return h, nil
+}
+
+// Called after each step of a migration, so tests can stop it there
+// as a crash would
+var migrationStep = func(step int) error { return nil }
+
+// Version 3 adds a checksum to the header, which grows and would
+// overwrite the start of the data.  The data is first copied past
+// where it ends up, then the new header is written marked as
+// migrating and the data is moved into place.  A crash before the
+// header is written leaves the old file, one after it is finished
+// from the copy the next time the file is opened.
+func migrateChecksum(mFile *mmapFileImpl, h header) (header, error) {
+	h.mSize = gomath.MaxInt64(0, gomath.MinInt64(h.mSize, mFile.mapSize-_LegacyHeaderSize))
+
+	needed := _HeaderSize + 2*h.mSize
+	if needed > mFile.mapSize {
+		if err := mFile.resize(needed); err != nil {
+			return h, err
+		}
+	}
+
+	if err := mFile.move(_LegacyHeaderSize, _HeaderSize+h.mSize, h.mSize); err != nil {
+		return h, err
+	} else if err = mFile.flush(); err != nil {
+		return h, err
+	} else if err = migrationStep(1); err != nil {
+		return h, err
+	}
+
+	if err := mFile.copyIn(0, encodeHeader(h.mSize, _Migrating)); err != nil {
+		return h, err
+	} else if err = mFile.flush(); err != nil {
+		return h, err
+	} else if err = migrationStep(2); err != nil {
+		return h, err
+	}
+
+	h.ver = 3
+	return finishMigration(mFile, h)
+}
+
+// Moves the data of a file migrated to version 3 from its copy into
+// place and clears the mark on the header
+func finishMigration(mFile *mmapFileImpl, h header) (header, error) {
+	if h.mSize < 0 || _HeaderSize+2*h.mSize > mFile.mapSize {
+		return h, errors.New("Migration cannot be finished, the copy of the data is missing")
+	}
+
+	if err := mFile.move(_HeaderSize+h.mSize, _HeaderSize, h.mSize); err != nil {
+		return h, err
+	} else if err = mFile.flush(); err != nil {
+		return h, err
+	}
+
+	if err := mFile.copyIn(0, encodeHeader(h.mSize, 0)); err != nil {
+		return h, err
+	} else if err = mFile.flush(); err != nil {
+		return h, err
+	}
+
+	h.migrating = false
+	h.valid = true
+	return h, nil
+}
+
+// Copies length bytes at from to to, both header included.  Copies
+// are made from the end so to may be after from.
+func (mFile *mmapFileImpl) move(from, to, length int64) error {
+	buffer := make([]byte, 64*1024)
+	for length > 0 {
+		chunk := buffer
+		if int64(len(chunk)) > length {
+			chunk = chunk[:length]
+		}
+		length -= int64(len(chunk))
+
+		if err := mFile.copyOut(from+length, chunk); err != nil {
+			return err
+		} else if err = mFile.copyIn(to+length, chunk); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (mFile *mmapFileImpl) writeHeader() {
+	mFile.copyIn(0, mFile.encodeHeader())
+	mFile.flush()
+}
+
+func (mFile *mmapFileImpl) encodeHeader() []byte {
+	return encodeHeader(mFile.size, 0)
+}
+
+// Encodes a header for the size of data in the given state
+func encodeHeader(size int64, state uint32) []byte {
+	// Writes of fixed size values to a buffer cannot fail
+	var buff bytes.Buffer
+	binary.Write(&buff, binary.BigEndian, _Sanity)
+	binary.Write(&buff, binary.BigEndian, _Version)
+	binary.Write(&buff, binary.BigEndian, size)
+	binary.Write(&buff, binary.BigEndian, crc32.ChecksumIEEE(buff.Bytes()))
+	binary.Write(&buff, binary.BigEndian, state)
+
+	return buff.Bytes()
+}
+
+func (mFile *mmapFileImpl) readHeader() (header, error) {
+	var result header
+	if mFile.mapSize < _LegacyHeaderSize {
+		return result, errors.New("File too small to hold a header")
+	}
+
+	raw := make([]byte, _LegacyHeaderSize)
+	if mFile.mapSize >= _HeaderSize {
+		raw = make([]byte, _HeaderSize)
+	}
+
+	if err := mFile.copyOut(0, raw); err != nil {
+		return result, err
+	}
+	buff := bytes.NewBuffer(raw)
+	result.sanity = make([]byte, 15)
+
+	binary.Read(buff, binary.BigEndian, &result.sanity)
+	binary.Read(buff, binary.BigEndian, &result.ver)
+	binary.Read(buff, binary.BigEndian, &result.mSize)
+
+	result.valid = true
+	if result.ver >= 3 && len(raw) == int(_HeaderSize) {
+		var state uint32
+		binary.Read(buff, binary.BigEndian, &result.checksum)
+		binary.Read(buff, binary.BigEndian, &state)
+		result.valid = result.checksum == crc32.ChecksumIEEE(raw[:_FieldsSize])
+		result.migrating = result.valid && state == _Migrating
+	} else if result.ver >= 3 {
+		result.valid = false
+	}
+
+	return result, nil
+}
+
+func (mFile *mmapFileImpl) sanityCheck(h header) error {
+	if !bytes.Equal(h.sanity, _Sanity) {
+		return errors.New("Sanity check failed, not a memory mapped file")
+	} else if h.ver == 0 || h.ver > _Version {
+		return fmt.Errorf("Versions do not match: %d vs. %d", h.ver, _Version)
+	}
+	return nil
+}
+
+// Reads and checks the header of an existing file, migrating the
+// file if it was written by an older version.  If the stored size
+// cannot be trusted, because the header is damaged or the file is
+// smaller than the size says after a crash, everything mapped is
+// assumed to have been written.
+func (mFile *mmapFileImpl) loadHeader() error {
+	head, err := mFile.readHeader()
+	if err != nil {
+		return err
+	} else if err = mFile.sanityCheck(head); err != nil {
+		return err
+	}
+
+	if head.ver < _Version && mFile.readOnly {
+		return fmt.Errorf("Version %d must be upgraded, cannot open read-only", head.ver)
+	}
+
+	// A migration which was interrupted after the header was written
+	if head.migrating && mFile.readOnly {
+		return errors.New("Migration was interrupted, cannot open read-only")
+	} else if head.migrating {
+		if head, err = finishMigration(mFile, head); err != nil {
+			return err
+		}
+	}
+
+	upgraded := head.ver < _Version
+	for head.ver < _Version {
+		migrate, exists := migrations[head.ver]
+		if !exists {
+			return fmt.Errorf("No migration from version %d", head.ver)
+		} else if head, err = migrate(mFile, head); err != nil {
+			return err
+		}
+	}
+
+	if mFile.mapSize < _HeaderSize {
+		return errors.New("File too small to hold a header")
+	}
+
+	mFile.size = head.mSize
+	if !head.valid || mFile.size < 0 || mFile.size+_HeaderSize > mFile.mapSize {
+		mFile.size = mFile.mapSize - _HeaderSize
+		head.valid = false
+	}
+
+	// Save the upgraded or recovered header
+	if (upgraded || !head.valid) && !mFile.readOnly {
+		mFile.writeHeader()
+	}
+	return nil
+}
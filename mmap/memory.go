@@ -0,0 +1,50 @@
+package mmap
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/deathly809/gofs"
+)
+
+// NewMemoryFile creates a File which is kept only in memory.  It has
+// the same header and grows the same way as a file on disk, but its
+// contents are lost when it is closed.  Windowed and ReadOnly files
+// cannot be kept in memory.
+func NewMemoryFile(name string, opts ...Option) (gofs.File, error) {
+	result := &mmapFileImpl{growth: Doubling, syncWrites: true}
+	result.name = name
+
+	for _, opt := range opts {
+		opt(result)
+	}
+
+	if result.windows != nil {
+		return nil, errors.New("Memory files cannot be windowed")
+	} else if result.readOnly {
+		return nil, errors.New("Cannot create a read-only memory file")
+	}
+
+	result.memory = true
+	result.newFile = true
+	result.lock = &sync.RWMutex{}
+	result.mapSize = _InitialSize
+	result.memmap = make([]byte, _InitialSize)
+	result.writeHeader()
+
+	return result, nil
+}
+
+// Replaces the memory of a memory file with a copy of the given size
+func (mFile *mmapFileImpl) resizeMemory(newSize int64) error {
+	if newSize < 0 {
+		return errors.New("Cannot resize to a negative size")
+	}
+
+	memory := make([]byte, newSize)
+	copy(memory, mFile.memmap)
+
+	mFile.memmap = memory
+	mFile.mapSize = newSize
+	return nil
+}
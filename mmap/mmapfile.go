@@ -1,15 +1,12 @@
 package mmap
 
 import (
-	"bytes"
-	"encoding/binary"
 	"errors"
-	"log"
+	"fmt"
 	"os"
 	"sync"
-	"unsafe"
+	"time"
 
-	"github.com/deathly809/goassert"
 	"github.com/deathly809/gomath"
 
 	"github.com/deathly809/gofs"
@@ -20,10 +17,17 @@ import (
 // File represents a File which is mapped to some place in memory
 type File interface {
 	gofs.File
-	// Bytes returns the underlying memory that the file backs
-	// If you want to use this you will need to lock the file
-	// before
-	Bytes() []byte
+
+	// View calls fn with the bytes written to the file.  The mapping
+	// cannot change until fn returns, other views and reads may run
+	// at the same time so fn must not modify the bytes.  Windowed
+	// files return ErrWindowed.
+	View(fn func([]byte) error) error
+
+	// Update calls fn with the bytes written to the file, which fn
+	// may modify.  Nothing else may use the file until fn returns.
+	// Windowed files return ErrWindowed.
+	Update(fn func([]byte) error) error
 
 	// Lock will lock the file from further reading or writing
 	// through the File Read/Write interface
@@ -32,49 +36,190 @@ type File interface {
 	// Unlock will allow the file to be written and read from using
 	// the File Read/Write interface
 	Unlock()
+
+	// Truncate changes the file to hold size bytes after the header,
+	// discarding anything past the end
+	Truncate(size int64) error
+
+	// Sync flushes all changes to the file to disk
+	Sync() error
+
+	// SyncRange flushes at least the changes to length bytes of the
+	// file starting at offset to disk
+	SyncRange(offset, length int64) error
+
+	// Advise tells the operating system how length bytes of the
+	// file starting at offset will be used
+	Advise(offset, length int64, advice Advice) error
+
+	// LockPages keeps length bytes of the file starting at offset
+	// in memory until UnlockPages is called for the same range.
+	// Unlike Lock it does not stop reads or writes.
+	LockPages(offset, length int64) error
+
+	// UnlockPages lets the pages locked by LockPages be paged out
+	UnlockPages(offset, length int64) error
 }
 
+// ErrClosed is returned by any call made on a file after it has been
+// closed
+var ErrClosed = errors.New("mmap: file closed")
+
 var _Sanity = []byte{0x0, 0x0, 0xd, 0x1, 0xe, 0x5, 0x0, 0xf, 0xd, 0x0, 0x0, 0xd, 0xa, 0xd, 0x5}
 
 const (
-	_Version     byte = byte(1)
+	_Version     byte = byte(3)
 	_MaxFileSize      = 1000000000
-	_HeaderSize       = int64(unsafe.Sizeof(_Version)+unsafe.Sizeof(1)) + 16
 	_InitialSize      = 4096 + _HeaderSize
 )
 
 /* Implementation */
 
-type header struct {
-	sanity []byte
-	ver    byte
-	mSize  int64
-}
-
 type mmapFileImpl struct {
 	memmap  mmap.MMap // mFile is just []byte
-	mapSize int64
-	newFile bool
-	file    *os.File
-	lock    *sync.Mutex
-	name    string
-	pos     int64
+	mapSize int64     // capacity of the mapping, header included
+	size    int64     // bytes written after the header
+	growth  GrowthPolicy
+	windows *windowCache // nil when the whole file is mapped
+	prot    int
+	hints   []hint // advice and page locks to apply again after remapping
+
+	syncWrites   bool          // flush after every write
+	syncInterval time.Duration // flush in the background, 0 if not
+	syncStop     chan struct{}
+	syncDone     chan struct{}
+
+	newFile  bool
+	readOnly bool
+	memory   bool // backed by memory rather than a file
+	closed   bool
+	file     *os.File
+	lock     *sync.RWMutex // guards the mapping, held for writing to change it
+	posLock  sync.Mutex    // guards pos while the mapping is shared
+	name     string
+	pos      int64
+}
+
+// GrowthPolicy returns the capacity to grow a file to when capacity
+// bytes are mapped and needed bytes are required.  The result must
+// be at least needed.
+type GrowthPolicy func(capacity, needed int64) int64
+
+// Doubling grows the mapping to twice its capacity, or to what is
+// needed if that is more, so appends take amortized constant time
+func Doubling(capacity, needed int64) int64 {
+	return gomath.MaxInt64(2*capacity, needed)
+}
+
+// Exact grows the mapping to exactly what is needed
+func Exact(capacity, needed int64) int64 {
+	return needed
+}
+
+// Option changes how NewFile opens a file
+type Option func(*mmapFileImpl)
+
+// Growth sets how the mapping grows when a write goes past its end.
+// The default is Doubling.
+func Growth(policy GrowthPolicy) Option {
+	return func(mFile *mmapFileImpl) {
+		mFile.growth = policy
+	}
+}
+
+// ReadOnly opens an existing file without write access.  The file
+// is mapped read-only, writes return gofs.ErrReadOnly and the
+// header is never rewritten.
+func ReadOnly() Option {
+	return func(mFile *mmapFileImpl) {
+		mFile.readOnly = true
+	}
 }
 
 /* Required for interface */
 
-func (mFile *mmapFileImpl) Bytes() []byte {
-	return mFile.memmap
+func (mFile *mmapFileImpl) View(fn func([]byte) error) error {
+	mFile.lock.RLock()
+	defer mFile.lock.RUnlock()
+
+	if mFile.closed {
+		return ErrClosed
+	} else if mFile.windows != nil {
+		return ErrWindowed
+	}
+	return fn(mFile.memmap[_HeaderSize : _HeaderSize+mFile.size])
+}
+
+func (mFile *mmapFileImpl) Update(fn func([]byte) error) error {
+	if mFile.readOnly {
+		return gofs.ErrReadOnly
+	}
+
+	mFile.lock.Lock()
+	defer mFile.lock.Unlock()
+
+	if mFile.closed {
+		return ErrClosed
+	} else if mFile.windows != nil {
+		return ErrWindowed
+	}
+
+	err := fn(mFile.memmap[_HeaderSize : _HeaderSize+mFile.size])
+	if mFile.syncWrites {
+		if flushErr := mFile.flush(); err == nil {
+			err = flushErr
+		}
+	}
+	return err
+}
+
+// Takes the lock needed to read from the mapping.  Using a window
+// may map or unmap others so windowed files must be locked for
+// writing.
+func (mFile *mmapFileImpl) readLock() {
+	if mFile.windows != nil {
+		mFile.lock.Lock()
+	} else {
+		mFile.lock.RLock()
+	}
+}
+
+func (mFile *mmapFileImpl) readUnlock() {
+	if mFile.windows != nil {
+		mFile.lock.Unlock()
+	} else {
+		mFile.lock.RUnlock()
+	}
 }
 
 // Close cleans up all resources, flushes, and closes the
-// memory mapped file
+// memory mapped file.  Closing it again returns an error.
 func (mFile *mmapFileImpl) Close() error {
-	mFile.writeHeader()
-	mFile.memmap.Flush()
-	err := mFile.memmap.Unmap()
+	mFile.lock.Lock()
+	if mFile.closed {
+		mFile.lock.Unlock()
+		return errors.New("File already closed")
+	}
+	mFile.closed = true
+	stop := mFile.syncStop
+	mFile.syncStop = nil
+	mFile.lock.Unlock()
 
-	if err != nil {
+	// The sync loop takes the lock so it is stopped without it
+	if stop != nil {
+		close(stop)
+		<-mFile.syncDone
+	}
+
+	mFile.lock.Lock()
+	defer mFile.lock.Unlock()
+
+	if !mFile.readOnly {
+		mFile.writeHeader()
+	}
+	err := mFile.unmap()
+
+	if err != nil || mFile.memory {
 		return err
 	}
 
@@ -87,26 +232,67 @@ func (mFile *mmapFileImpl) Close() error {
 }
 
 func (mFile *mmapFileImpl) Write(data []byte) (int, error) {
+	if mFile.readOnly {
+		return 0, gofs.ErrReadOnly
+	}
+
+	mFile.lock.Lock()
+	defer mFile.lock.Unlock()
+
+	if mFile.closed {
+		return 0, ErrClosed
+	}
+
 	start := mFile.pos + _HeaderSize
 	end := start + int64(len(data))
 
-	mFile.lock.Lock()
 	if end > mFile.mapSize {
-		mFile.grow(end + _HeaderSize)
+		if err := mFile.resize(mFile.growth(mFile.mapSize, end)); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := mFile.copyIn(start, data); err != nil {
+		return 0, err
 	}
+	mFile.pos = end - _HeaderSize // we have moved
 
-	to := mFile.memmap[start:]
-	if len(to) < len(data) {
-		log.Fatal("Not enough space, didn't we grow?")
+	var err error
+	if mFile.pos > mFile.size {
+		mFile.size = mFile.pos
+		err = mFile.copyIn(0, mFile.encodeHeader())
 	}
 
-	length := copy(to, data)
-	mFile.pos = end // we have moved
+	if err == nil && mFile.syncWrites {
+		err = mFile.flush()
+	}
 
-	mFile.lock.Unlock()
-	mFile.memmap.Flush()
+	if err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+func (mFile *mmapFileImpl) Truncate(size int64) error {
+	if mFile.readOnly {
+		return gofs.ErrReadOnly
+	} else if size < 0 {
+		return errors.New("Cannot truncate to a negative size")
+	}
 
-	return length, nil
+	mFile.lock.Lock()
+	defer mFile.lock.Unlock()
+
+	if mFile.closed {
+		return ErrClosed
+	} else if err := mFile.resize(size + _HeaderSize); err != nil {
+		return err
+	}
+	mFile.size = size
+	mFile.pos = gomath.MinInt64(mFile.pos, size)
+	mFile.writeHeader()
+
+	return nil
 }
 
 func (mFile *mmapFileImpl) Lock() {
@@ -117,26 +303,54 @@ func (mFile *mmapFileImpl) Unlock() {
 	mFile.lock.Unlock()
 }
 
-func (mFile *mmapFileImpl) Seek(pos int64, from int) (int64,error){
+func (mFile *mmapFileImpl) Seek(pos int64, from int) (int64, error) {
+	mFile.lock.RLock()
+	defer mFile.lock.RUnlock()
+
+	if mFile.closed {
+		return 0, ErrClosed
+	}
+
+	mFile.posLock.Lock()
+	defer mFile.posLock.Unlock()
+
 	switch from {
 	case os.SEEK_SET:
 		mFile.pos = pos
 	case os.SEEK_CUR:
-		mFile.pos = pos + pos
+		mFile.pos += pos
 	case os.SEEK_END:
-		mFile.pos = mFile.mapSize - pos
+		mFile.pos = mFile.size - pos
 	}
-	mFile.pos = gomath.MaxInt64(0, gomath.MinInt64(mFile.pos, mFile.mapSize-1))
-    return mFile.pos,nil
+	mFile.pos = gomath.MaxInt64(0, gomath.MinInt64(mFile.pos, mFile.size))
+	return mFile.pos, nil
 }
 
+// Size returns the number of bytes written to the file, which may
+// be less than the space mapped for it.  A closed file has no size.
 func (mFile *mmapFileImpl) Size() int64 {
-	return mFile.mapSize
+	mFile.lock.RLock()
+	defer mFile.lock.RUnlock()
+
+	if mFile.closed {
+		return 0
+	}
+	return mFile.size
 }
 
 func (mFile *mmapFileImpl) Read(data []byte) (int, error) {
+	mFile.readLock()
+	defer mFile.readUnlock()
+
+	if mFile.closed {
+		return 0, ErrClosed
+	}
+
+	mFile.posLock.Lock()
+	defer mFile.posLock.Unlock()
+
 	start := _HeaderSize + mFile.pos
-	end := gomath.MinInt64(mFile.mapSize, start+int64(len(data)))
+	end := gomath.MinInt64(_HeaderSize+mFile.size, start+int64(len(data)))
 
 	length := end - start
 
@@ -144,18 +358,16 @@ func (mFile *mmapFileImpl) Read(data []byte) (int, error) {
 		return 0, errors.New("Tried to read beyond end of file")
 	}
 
-	if length > _MaxFileSize {
-		log.Fatal("File too large")
+	if length > _MaxFileSize && mFile.windows == nil {
+		return 0, errors.New("File too large")
 	}
 
-	check := int64(copy(data, mFile.memmap[start:]))
-
-	if check != length {
-		log.Fatal("Could not read entire length")
+	if err := mFile.copyOut(start, data[:length]); err != nil {
+		return 0, err
 	}
 
 	// Moved on
-	mFile.pos = end
+	mFile.pos = end - _HeaderSize
 
 	return int(length), nil
 }
@@ -173,71 +385,89 @@ func (mFile *mmapFileImpl) Name() string {
 
 /* Required to work */
 
-func (mFile *mmapFileImpl) grow(newSize int64) {
-	// Get the new size
-	mFile.mapSize = newSize
+// Changes the size of the backing file, header included, and maps
+// it again.  Windows are mapped again when they are next used.
+func (mFile *mmapFileImpl) resize(newSize int64) error {
+	if mFile.memory {
+		return mFile.resizeMemory(newSize)
+	}
 
 	// Flush and unmap
-	mFile.memmap.Flush()
-	mFile.memmap.Unmap()
-	mFile.memmap = nil
-
-	// Grow the file
-	mFile.file.Truncate(mFile.mapSize)
-
-	var err error
+	if err := mFile.unmap(); err != nil {
+		return err
+	}
 
-	mFile.memmap, err = mmap.Map(mFile.file, mmap.RDWR, 0)
+	// Resize the file, if that fails it is mapped again as it was so
+	// it can still be used
+	resizeErr := mFile.file.Truncate(newSize)
+	if resizeErr == nil {
+		mFile.mapSize = newSize
+	}
 
-	if err != nil {
-		log.Fatal("Could not resize file, handle gracefully later: ", err.Error())
+	if mFile.windows != nil {
+		return resizeErr
 	}
 
-	if mFile.memmap == nil {
-		log.Fatal("Could not resize file, handle gracefully later(2)")
+	var err error
+	mFile.memmap, err = mmap.Map(mFile.file, mFile.prot, 0)
+	if err != nil {
+		return err
+	} else if resizeErr != nil {
+		mFile.applyHints(mFile.memmap, 0)
+		return resizeErr
 	}
 
-	if int64(len(mFile.memmap)) != mFile.mapSize {
-		log.Fatal("Backing mapped array not same size")
+	if int64(len(mFile.memmap)) != newSize {
+		return errors.New("Backing mapped array not same size")
 	}
 
+	mFile.applyHints(mFile.memmap, 0)
+	return nil
 }
 
-func (mFile *mmapFileImpl) writeHeader() {
-
-	var buff bytes.Buffer
-	err := binary.Write(&buff, binary.BigEndian, _Sanity)
-	if err != nil {
-		log.Fatal(err.Error())
+// Copies data into the file at offset, header included
+func (mFile *mmapFileImpl) copyIn(offset int64, data []byte) error {
+	if mFile.windows != nil {
+		return mFile.copyWindows(offset, data, true)
+	} else if copy(mFile.memmap[offset:], data) != len(data) {
+		return errors.New("Not enough space, didn't we grow?")
 	}
+	return nil
+}
 
-	err = binary.Write(&buff, binary.BigEndian, _Version)
-	if err != nil {
-		log.Fatal(err.Error())
+// Copies from the file at offset, header included, into data
+func (mFile *mmapFileImpl) copyOut(offset int64, data []byte) error {
+	if mFile.windows != nil {
+		return mFile.copyWindows(offset, data, false)
+	} else if copy(data, mFile.memmap[offset:]) != len(data) {
+		return errors.New("Could not read entire length")
 	}
+	return nil
+}
 
-	err = binary.Write(&buff, binary.BigEndian, int64(mFile.mapSize))
-	if err != nil {
-		log.Fatal(err.Error())
+// Writes the mapped memory back to the file
+func (mFile *mmapFileImpl) flush() error {
+	if mFile.memory {
+		return nil
+	} else if mFile.windows != nil {
+		return mFile.windows.flush()
 	}
-	copy(mFile.memmap, buff.Bytes())
-	mFile.memmap.Flush()
+	return mFile.memmap.Flush()
 }
 
-func (mFile *mmapFileImpl) readHeader() header {
-	var result header
-	buff := bytes.NewBuffer(mFile.memmap[:_HeaderSize])
-	result.sanity = make([]byte, 15)
-
-	binary.Read(buff, binary.BigEndian, &result.sanity)
-	binary.Read(buff, binary.BigEndian, &result.ver)
-	binary.Read(buff, binary.BigEndian, &result.mSize)
-
-	return result
-}
+// Flushes and unmaps all mapped memory
+func (mFile *mmapFileImpl) unmap() error {
+	if mFile.windows != nil {
+		return mFile.windows.unmap()
+	} else if mFile.memmap == nil || mFile.memory {
+		mFile.memmap = nil
+		return nil
+	}
 
-func (mFile *mmapFileImpl) sanityCheck(h header) bool {
-	return true
+	mFile.memmap.Flush()
+	err := mFile.memmap.Unmap()
+	mFile.memmap = nil
+	return err
 }
 
 func (mFile *mmapFileImpl) align(offset int) int {
@@ -249,49 +479,79 @@ func (mFile *mmapFileImpl) align(offset int) int {
 /* Constructors */
 
 // NewFile creates a new memory mapped file
-func NewFile(fName string) (gofs.File, error) {
+func NewFile(fName string, opts ...Option) (gofs.File, error) {
 	var err error
 
-	result := &mmapFileImpl{}
+	result := &mmapFileImpl{growth: Doubling, syncWrites: true}
 	result.name = fName
 
+	for _, opt := range opts {
+		opt(result)
+	}
+
+	if result.windows != nil {
+		if err = result.windows.validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	flag := os.O_CREATE | os.O_RDWR
+	result.prot = mmap.RDWR
+	if result.readOnly {
+		flag, result.prot = os.O_RDONLY, mmap.RDONLY
+	}
+
 	// Create/Open file
-	result.file, err = os.OpenFile(fName, os.O_CREATE|os.O_RDWR, 0644)
+	result.file, err = os.OpenFile(fName, flag, 0644)
 	if err != nil {
 		return nil, errors.New("Could not open file for reading")
 	}
 
 	// Check to see if new
-	info, _ := os.Stat(fName)
-	result.mapSize = gomath.MaxInt64(_InitialSize, info.Size())
+	info, _ := result.file.Stat()
+	result.mapSize = info.Size()
 
 	if info.Size() == 0 {
+		if result.readOnly {
+			result.file.Close()
+			return nil, errors.New("Cannot open an empty file read-only")
+		}
 		result.newFile = true
+		result.mapSize = _InitialSize
 		result.file.Truncate(int64(result.mapSize))
 	} else {
 		result.newFile = false
 	}
 
-	// Map file to memory
-	result.memmap, err = mmap.Map(result.file, mmap.RDWR, 0)
+	// Map file to memory, windows are mapped as they are used
+	if result.windows == nil {
+		result.memmap, err = mmap.Map(result.file, result.prot, 0)
+	}
 
 	// Validate
 	if err != nil {
+		result.file.Close()
 		return nil, err
 	}
 
-	result.lock = &sync.Mutex{}
+	result.lock = &sync.RWMutex{}
 
 	if !result.newFile {
-
-		head := result.readHeader()
-
-		goassert.Assert(bytes.Equal(head.sanity, _Sanity), "Sanity check failed '"+string(head.sanity)+"'")
-		goassert.Assert(head.ver == _Version, "Versions do not match: ", head.ver, " vs. ", _Version)
-		goassert.Assert(head.mSize == result.mapSize, fName+": Sizes do not match: ", head.mSize, result.mapSize)
-
+		err = result.loadHeader()
 	} else {
 		result.writeHeader()
 	}
+
+	if err != nil {
+		result.unmap()
+		result.file.Close()
+		return nil, fmt.Errorf("%s: %v", fName, err)
+	}
+
+	if result.syncInterval > 0 && !result.readOnly {
+		result.syncStop = make(chan struct{})
+		result.syncDone = make(chan struct{})
+		go result.syncLoop(result.syncStop)
+	}
 	return result, nil
 }
@@ -2,10 +2,16 @@ package mmap
 
 import (
 	"bytes"
+	"encoding/binary"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/deathly809/gofs"
 )
 
 const (
@@ -161,6 +167,685 @@ func TestRead_LargeFile(t *testing.T) {
 	}
 }
 
+func TestReadOnly(t *testing.T) {
+	roPath := testPath + "-ro"
+	defer os.Remove(roPath)
+
+	file, err := NewFile(roPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	file.Write(testData)
+	file.Close()
+
+	before, _ := os.ReadFile(roPath)
+
+	file, err = NewFile(roPath, ReadOnly())
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	data := make([]byte, len(testData))
+	n, err := file.Read(data)
+	if n != len(testData) || err != nil {
+		t.Error("Did not read all data from file")
+	}
+
+	if !bytes.Equal(testData, data) {
+		t.Error("Data not the same")
+	}
+
+	n, err = file.Write(testData)
+	if n != 0 || err != gofs.ErrReadOnly {
+		t.Error("Write to a read-only file did not fail: ", err)
+	}
+
+	if err = file.Close(); err != nil {
+		t.Error(err.Error())
+	}
+
+	after, _ := os.ReadFile(roPath)
+	if !bytes.Equal(before, after) {
+		t.Error("Read-only file was modified")
+	}
+}
+
+func TestReadOnly_Changes(t *testing.T) {
+	roPath := testPath + "-rochanges"
+	defer os.Remove(roPath)
+
+	file, err := NewFile(roPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	file.Write(testData)
+	file.Close()
+
+	file, err = NewFile(roPath, ReadOnly())
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer file.Close()
+	mFile := file.(File)
+
+	if err = mFile.Truncate(0); err != gofs.ErrReadOnly {
+		t.Error("Truncated a read-only file: ", err)
+	}
+
+	called := false
+	if err = mFile.Update(func([]byte) error { called = true; return nil }); err != gofs.ErrReadOnly || called {
+		t.Error("Updated a read-only file: ", err)
+	}
+
+	// Viewing is still allowed
+	err = mFile.View(func(data []byte) error {
+		if !bytes.Equal(data, testData) {
+			t.Error("Data not the same")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err.Error())
+	} else if mFile.Size() != int64(len(testData)) {
+		t.Error("Size changed: ", mFile.Size())
+	}
+}
+
+func TestReadOnly_Missing(t *testing.T) {
+	file, err := NewFile(testPath+"-missing", ReadOnly())
+	if err == nil {
+		file.Close()
+		t.Error("Opened a missing file read-only")
+	}
+
+	if _, err := os.Stat(testPath + "-missing"); err == nil {
+		t.Error("Read-only open created a file")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	truncPath := testPath + "-trunc"
+	defer os.Remove(truncPath)
+
+	file, err := NewFile(truncPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	file.Write(make([]byte, _LargeFile))
+	file.Seek(0, os.SEEK_SET)
+	file.Write(testData)
+
+	mFile := file.(File)
+	if err = mFile.Truncate(int64(len(testData))); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	file.Close()
+
+	info, _ := os.Stat(truncPath)
+	if info.Size() != int64(len(testData))+_HeaderSize {
+		t.Error("Incorrect size after truncate: ", info.Size())
+	}
+
+	file, err = NewFile(truncPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer file.Close()
+
+	data := make([]byte, len(testData))
+	n, err := file.Read(data)
+	if n != len(testData) || err != nil || !bytes.Equal(data, testData) {
+		t.Error("Data not the same after truncate")
+	}
+}
+
+func TestGrowth(t *testing.T) {
+	growPath := testPath + "-grow"
+	defer os.Remove(growPath)
+
+	file, err := NewFile(growPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	for i := 0; i < 1000; i++ {
+		file.Write(testData)
+	}
+	expected := int64(1000 * len(testData))
+
+	if file.Size() != expected {
+		t.Error("Incorrect size after appends: ", file.Size())
+	}
+	file.Close()
+
+	info, _ := os.Stat(growPath)
+	if info.Size() < expected+_HeaderSize || info.Size() > 2*(expected+_HeaderSize) {
+		t.Error("Incorrect capacity after appends: ", info.Size())
+	}
+
+	file, err = NewFile(growPath, Growth(Exact))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer file.Close()
+
+	if file.Size() != expected {
+		t.Error("Size not persisted: ", file.Size())
+	}
+
+	file.Seek(0, os.SEEK_END)
+	file.Write(make([]byte, info.Size()))
+	if file.Size() != expected+info.Size() {
+		t.Error("Incorrect size after growing exactly: ", file.Size())
+	}
+}
+
+func TestGrowth_Fails(t *testing.T) {
+	growPath := testPath + "-growfail"
+	defer os.Remove(growPath)
+
+	file, err := NewFile(growPath, Growth(func(capacity, needed int64) int64 {
+		return -1
+	}))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer file.Close()
+
+	file.Write(testData)
+	if n, err := file.Write(make([]byte, _InitialSize)); n != 0 || err == nil {
+		t.Error("Wrote past the end of a file which could not grow")
+	}
+
+	// What was written before is still there
+	data := make([]byte, len(testData))
+	file.Seek(0, os.SEEK_SET)
+	if n, err := file.Read(data); n != len(data) || err != nil || !bytes.Equal(data, testData) {
+		t.Error("Could not read the file after it failed to grow: ", err)
+	} else if file.Size() != int64(len(testData)) {
+		t.Error("Incorrect size after failing to grow: ", file.Size())
+	}
+}
+
+func TestWindowed(t *testing.T) {
+	windowPath := testPath + "-window"
+	defer os.Remove(windowPath)
+
+	pageSize := int64(os.Getpagesize())
+	data := make([]byte, 10*pageSize+123)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	file, err := NewFile(windowPath, Windowed(pageSize, 2))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if n, err := file.Write(data); n != len(data) || err != nil {
+		t.Error("Did not write all data to file: ", err)
+	}
+
+	if err = file.(File).View(func([]byte) error { return nil }); err != ErrWindowed {
+		t.Error("Windowed file returned its bytes")
+	} else if err = file.(File).Update(func([]byte) error { return nil }); err != ErrWindowed {
+		t.Error("Windowed file returned its bytes to update")
+	}
+
+	if mapped := file.(*mmapFileImpl).windows.lru.Len(); mapped > 2 {
+		t.Error("Too many windows mapped: ", mapped)
+	}
+	file.Close()
+
+	file, err = NewFile(windowPath, Windowed(pageSize, 2))
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer file.Close()
+
+	test := make([]byte, len(data))
+	if n, err := file.Read(test); n != len(data) || err != nil {
+		t.Error("Did not read all data from file: ", err)
+	}
+
+	if !bytes.Equal(data, test) {
+		t.Error("Data not correct")
+	}
+}
+
+func TestWindowed_BadSize(t *testing.T) {
+	file, err := NewFile(testPath+"-badwindow", Windowed(100, 1))
+	if err == nil {
+		file.Close()
+		t.Error("Opened a file with a window size which is not a multiple of the page size")
+	}
+}
+
+func TestSync(t *testing.T) {
+	syncPath := testPath + "-sync"
+	defer os.Remove(syncPath)
+
+	for _, opt := range []Option{SyncWrites(), SyncOnClose(), SyncEvery(time.Millisecond)} {
+		os.Remove(syncPath)
+
+		file, err := NewFile(syncPath, opt)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		mFile := file.(File)
+
+		mFile.Write(testData)
+		if err = mFile.SyncRange(0, int64(len(testData))); err != nil {
+			t.Error(err.Error())
+		}
+
+		mFile.Write(testData)
+		if err = mFile.Sync(); err != nil {
+			t.Error(err.Error())
+		}
+
+		time.Sleep(5 * time.Millisecond)
+		if err = mFile.Close(); err != nil {
+			t.Error(err.Error())
+		}
+
+		stored, _ := os.ReadFile(syncPath)
+		if !bytes.Equal(stored[_HeaderSize:_HeaderSize+int64(len(testData))], testData) {
+			t.Error("Data not synced")
+		}
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	closePath := testPath + "-close"
+	defer os.Remove(closePath)
+
+	for _, opt := range []Option{SyncWrites(), SyncEvery(time.Millisecond)} {
+		file, err := NewFile(closePath, opt)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		if err = file.Close(); err != nil {
+			t.Error(err.Error())
+		} else if err = file.Close(); err == nil {
+			t.Error("Closed a file twice")
+		}
+	}
+}
+
+func TestClosed(t *testing.T) {
+	closedPath := testPath + "-closed"
+	defer os.Remove(closedPath)
+
+	pageSize := int64(os.Getpagesize())
+	for _, opts := range [][]Option{nil, {Windowed(pageSize, 2)}, {SyncEvery(time.Millisecond)}} {
+		os.Remove(closedPath)
+
+		f, err := NewFile(closedPath, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(testData)
+		if err = f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		file := f.(File)
+
+		calls := map[string]func() error{
+			"Read":      func() error { _, err := file.Read(make([]byte, 4)); return err },
+			"Write":     func() error { _, err := file.Write(testData); return err },
+			"Seek":      func() error { _, err := file.Seek(0, os.SEEK_SET); return err },
+			"View":      func() error { return file.View(func([]byte) error { return nil }) },
+			"Update":    func() error { return file.Update(func([]byte) error { return nil }) },
+			"Truncate":  func() error { return file.Truncate(0) },
+			"Sync":      func() error { return file.Sync() },
+			"SyncRange": func() error { return file.SyncRange(0, 1) },
+			"Advise":    func() error { return file.Advise(0, 1, AdviseNormal) },
+			"LockPages": func() error { return file.LockPages(0, 1) },
+		}
+		for name, call := range calls {
+			if err = call(); err != ErrClosed {
+				t.Errorf("%s after close returned %v", name, err)
+			}
+		}
+
+		if file.Size() != 0 {
+			t.Errorf("closed file has size %d", file.Size())
+		}
+	}
+}
+
+func TestAdvise(t *testing.T) {
+	advisePath := testPath + "-advise"
+	defer os.Remove(advisePath)
+
+	pageSize := int64(os.Getpagesize())
+	for _, opts := range [][]Option{nil, {Windowed(pageSize, 2)}} {
+		os.Remove(advisePath)
+
+		file, err := NewFile(advisePath, opts...)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		mFile := file.(File)
+
+		if err = mFile.Advise(0, pageSize, AdviseSequential); err != nil {
+			t.Error(err.Error())
+		}
+		if err = mFile.Advise(0, pageSize, Advice(100)); err == nil {
+			t.Error("Unknown advice accepted")
+		}
+		if err = mFile.LockPages(0, pageSize); err != nil {
+			t.Log("Could not lock pages: ", err)
+		}
+
+		// Grows, and so remaps, the file
+		data := make([]byte, 4*pageSize)
+		if n, err := mFile.Write(data); n != len(data) || err != nil {
+			t.Error("Did not write all data to file: ", err)
+		}
+
+		if err = mFile.Advise(pageSize, 2*pageSize, AdviseRandom); err != nil {
+			t.Error(err.Error())
+		}
+		mFile.UnlockPages(0, pageSize)
+
+		if err = mFile.Close(); err != nil {
+			t.Error(err.Error())
+		}
+	}
+}
+
+// Writes a file the way version 1 or 2 did, a 25 byte header
+// without a checksum followed by data
+func writeLegacyFile(path string, ver byte, data []byte) {
+	size := int64(len(data))
+	if ver == 1 {
+		size += _LegacyHeaderSize
+	}
+
+	var buff bytes.Buffer
+	buff.Write(_Sanity)
+	buff.WriteByte(ver)
+	binary.Write(&buff, binary.BigEndian, size)
+	buff.WriteByte(0)
+	buff.Write(data)
+
+	os.WriteFile(path, buff.Bytes(), 0644)
+}
+
+func TestMigrate(t *testing.T) {
+	migratePath := testPath + "-migrate"
+	defer os.Remove(migratePath)
+
+	for _, ver := range []byte{1, 2} {
+		writeLegacyFile(migratePath, ver, testData)
+
+		file, err := NewFile(migratePath)
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+
+		if file.Size() != int64(len(testData)) {
+			t.Error("Incorrect size after migrating version ", ver, ": ", file.Size())
+		}
+
+		data := make([]byte, len(testData))
+		if n, err := file.Read(data); n != len(data) || err != nil || !bytes.Equal(data, testData) {
+			t.Error("Data not the same after migrating version ", ver)
+		}
+		file.Close()
+
+		file, err = NewFile(migratePath, ReadOnly())
+		if err != nil {
+			t.Error(err.Error())
+			return
+		}
+		if file.Size() != int64(len(testData)) {
+			t.Error("Migration not saved for version ", ver)
+		}
+		file.Close()
+	}
+}
+
+func TestMigrate_Interrupted(t *testing.T) {
+	migratePath := testPath + "-migrate-interrupted"
+	defer os.Remove(migratePath)
+	defer func() { migrationStep = func(int) error { return nil } }()
+
+	errCrash := errors.New("crashed")
+	for _, step := range []int{1, 2} {
+		writeLegacyFile(migratePath, 2, testData)
+
+		migrationStep = func(at int) error {
+			if at == step {
+				return errCrash
+			}
+			return nil
+		}
+		if file, err := NewFile(migratePath); err == nil {
+			file.Close()
+			t.Fatal("Migration not interrupted at step ", step)
+		}
+		migrationStep = func(int) error { return nil }
+
+		// Once the header is written the data may be part way into
+		// place, a read-only open cannot finish moving it
+		if step == 2 {
+			raw, _ := os.ReadFile(migratePath)
+			copy(raw[_HeaderSize:], make([]byte, len(testData)/2))
+			os.WriteFile(migratePath, raw, 0644)
+
+			if file, err := NewFile(migratePath, ReadOnly()); err == nil {
+				file.Close()
+				t.Error("Opened an interrupted migration read-only")
+			}
+		}
+
+		file, err := NewFile(migratePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := make([]byte, len(testData))
+		if file.Size() != int64(len(testData)) {
+			t.Error("Incorrect size after interrupting step ", step, ": ", file.Size())
+		} else if n, err := file.Read(data); n != len(data) || err != nil || !bytes.Equal(data, testData) {
+			t.Error("Data not the same after interrupting step ", step)
+		}
+		file.Close()
+	}
+}
+
+func TestMigrate_ReadOnly(t *testing.T) {
+	migratePath := testPath + "-migrate-ro"
+	defer os.Remove(migratePath)
+
+	writeLegacyFile(migratePath, 2, testData)
+	if file, err := NewFile(migratePath, ReadOnly()); err == nil {
+		file.Close()
+		t.Error("Migrated a file opened read-only")
+	}
+}
+
+func TestRecover(t *testing.T) {
+	recoverPath := testPath + "-recover"
+	defer os.Remove(recoverPath)
+
+	file, err := NewFile(recoverPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	file.Write(testData)
+	file.Close()
+
+	// Damage the size so the checksum no longer matches
+	raw, _ := os.ReadFile(recoverPath)
+	raw[_FieldsSize-1] ^= 0xff
+	os.WriteFile(recoverPath, raw, 0644)
+
+	file, err = NewFile(recoverPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if file.Size() != int64(len(raw))-_HeaderSize {
+		t.Error("Size not recovered: ", file.Size())
+	}
+
+	data := make([]byte, len(testData))
+	if n, err := file.Read(data); n != len(data) || err != nil || !bytes.Equal(data, testData) {
+		t.Error("Data not the same after recovering")
+	}
+	file.Close()
+}
+
+func TestSanity(t *testing.T) {
+	sanityPath := testPath + "-sanity"
+	defer os.Remove(sanityPath)
+
+	os.WriteFile(sanityPath, make([]byte, _InitialSize), 0644)
+	if file, err := NewFile(sanityPath); err == nil {
+		file.Close()
+		t.Error("Opened a file without a header")
+	}
+}
+
+func TestView(t *testing.T) {
+	viewPath := testPath + "-view"
+	defer os.Remove(viewPath)
+
+	file, err := NewFile(viewPath)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	defer file.Close()
+	mFile := file.(File)
+
+	mFile.Write(testData)
+
+	err = mFile.Update(func(data []byte) error {
+		data[0] = 'X'
+		return nil
+	})
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	// Seek and Write are not atomic together so there is one writer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for j := 0; j < 400; j++ {
+			mFile.Seek(0, os.SEEK_END)
+			mFile.Write(testData)
+		}
+	}()
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				mFile.View(func(data []byte) error {
+					if data[0] != 'X' {
+						t.Error("Update not seen")
+					}
+					return nil
+				})
+				mFile.Size()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if mFile.Size() != int64(401*len(testData)) {
+		t.Error("Incorrect size after concurrent writes: ", mFile.Size())
+	}
+}
+
+func TestMemoryFile(t *testing.T) {
+	file, err := NewMemoryFile("memory")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	mFile := file.(File)
+
+	if !mFile.IsNew() || mFile.Size() != 0 {
+		t.Error("Memory file not empty")
+	}
+
+	data := make([]byte, _LargeFile)
+	for i := range data {
+		data[i] = byte(i % 256)
+	}
+
+	if n, err := mFile.Write(data); n != len(data) || err != nil {
+		t.Error("Did not write all data to file: ", err)
+	}
+
+	test := make([]byte, len(data))
+	mFile.Seek(0, os.SEEK_SET)
+	if n, err := mFile.Read(test); n != len(data) || err != nil || !bytes.Equal(data, test) {
+		t.Error("Data not the same")
+	}
+
+	if err = mFile.Truncate(int64(len(testData))); err != nil {
+		t.Error(err.Error())
+	}
+
+	err = mFile.View(func(view []byte) error {
+		if !bytes.Equal(view, data[:len(testData)]) {
+			t.Error("Data not the same after truncate")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Error(err.Error())
+	}
+
+	if err = mFile.Sync(); err != nil {
+		t.Error(err.Error())
+	}
+	if err = mFile.Close(); err != nil {
+		t.Error(err.Error())
+	}
+
+	if _, err := os.Stat("memory"); err == nil {
+		t.Error("Memory file written to disk")
+	}
+}
+
+func TestMemoryFile_Options(t *testing.T) {
+	if _, err := NewMemoryFile("memory", ReadOnly()); err == nil {
+		t.Error("Created a read-only memory file")
+	}
+	if _, err := NewMemoryFile("memory", Windowed(int64(os.Getpagesize()), 1)); err == nil {
+		t.Error("Created a windowed memory file")
+	}
+}
+
 func TestTearDown(t *testing.T) {
 	os.Remove(testPath)
 	info, err := os.Stat(testPath)
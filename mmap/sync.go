@@ -0,0 +1,104 @@
+package mmap
+
+import (
+	"errors"
+	"time"
+
+	"github.com/deathly809/gomath"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// SyncWrites flushes the mapping to disk after every write.  This
+// is the default.
+func SyncWrites() Option {
+	return func(mFile *mmapFileImpl) {
+		mFile.syncWrites = true
+		mFile.syncInterval = 0
+	}
+}
+
+// SyncOnClose only flushes the mapping to disk when the file is
+// closed, or Sync or SyncRange is called
+func SyncOnClose() Option {
+	return func(mFile *mmapFileImpl) {
+		mFile.syncWrites = false
+		mFile.syncInterval = 0
+	}
+}
+
+// SyncEvery flushes the mapping to disk in the background once
+// every interval, as well as when the file is closed
+func SyncEvery(interval time.Duration) Option {
+	return func(mFile *mmapFileImpl) {
+		mFile.syncWrites = false
+		mFile.syncInterval = interval
+	}
+}
+
+func (mFile *mmapFileImpl) Sync() error {
+	mFile.readLock()
+	defer mFile.readUnlock()
+
+	if mFile.closed {
+		return ErrClosed
+	}
+	return mFile.flush()
+}
+
+func (mFile *mmapFileImpl) SyncRange(offset, length int64) error {
+	if offset < 0 || length < 0 {
+		return errors.New("Cannot sync a negative range")
+	}
+
+	mFile.readLock()
+	defer mFile.readUnlock()
+
+	if mFile.closed {
+		return ErrClosed
+	}
+
+	start := _HeaderSize + offset
+	end := gomath.MinInt64(start+length, mFile.mapSize)
+	if start >= end || mFile.memory {
+		return nil
+	}
+
+	// Mappings can only be flushed from where they begin, so the
+	// memory before the range is flushed along with it
+	if mFile.windows == nil {
+		return mmap.MMap(mFile.memmap[:end]).Flush()
+	}
+
+	size := mFile.windows.size
+	for index := start / size; index*size < end; index++ {
+		elem, mapped := mFile.windows.byIndex[index]
+		if !mapped {
+			continue
+		}
+
+		data := elem.Value.(*window).data
+		last := gomath.MinInt64(end-index*size, int64(len(data)))
+		if err := mmap.MMap(data[:last]).Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flushes the mapping every syncInterval until stop is closed
+func (mFile *mmapFileImpl) syncLoop(stop chan struct{}) {
+	defer close(mFile.syncDone)
+
+	ticker := time.NewTicker(mFile.syncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			mFile.Sync()
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package mmap
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/deathly809/gomath"
+
+	"github.com/edsrzf/mmap-go"
+)
+
+// ErrWindowed is returned by View and Update for a windowed file, as
+// its bytes are never all mapped at once
+var ErrWindowed = errors.New("mmap: not supported for a windowed file")
+
+// A part of the file mapped into memory
+type window struct {
+	index int64 // offset of the window divided by the window size
+	data  mmap.MMap
+}
+
+// The windows of a file which are currently mapped, the most
+// recently used at the front
+type windowCache struct {
+	size    int64
+	max     int
+	lru     *list.List
+	byIndex map[int64]*list.Element
+}
+
+// Windowed maps only windows of size bytes of the file at a time,
+// keeping at most count of them mapped and unmapping the least
+// recently used first.  The size must be a multiple of the page
+// size.  View and Update return ErrWindowed for a windowed file.
+func Windowed(size int64, count int) Option {
+	return func(mFile *mmapFileImpl) {
+		mFile.windows = &windowCache{
+			size:    size,
+			max:     count,
+			lru:     list.New(),
+			byIndex: make(map[int64]*list.Element),
+		}
+	}
+}
+
+// Checks the window settings are usable
+func (cache *windowCache) validate() error {
+	if cache.size <= 0 || cache.size%int64(os.Getpagesize()) != 0 {
+		return fmt.Errorf("window size %d is not a multiple of the page size", cache.size)
+	} else if cache.max <= 0 {
+		return fmt.Errorf("at least one window must be mapped, not %d", cache.max)
+	}
+	return nil
+}
+
+// Returns the window with the given index, mapping it if needed
+func (mFile *mmapFileImpl) window(index int64) (mmap.MMap, error) {
+	cache := mFile.windows
+	if elem, exists := cache.byIndex[index]; exists {
+		cache.lru.MoveToFront(elem)
+		return elem.Value.(*window).data, nil
+	}
+
+	if cache.lru.Len() >= cache.max {
+		if err := cache.evict(cache.lru.Back()); err != nil {
+			return nil, err
+		}
+	}
+
+	offset := index * cache.size
+	length := gomath.MinInt64(cache.size, mFile.mapSize-offset)
+
+	data, err := mmap.MapRegion(mFile.file, int(length), mFile.prot, 0, offset)
+	if err != nil {
+		return nil, err
+	}
+	mFile.applyHints(data, offset)
+
+	cache.byIndex[index] = cache.lru.PushFront(&window{index: index, data: data})
+	return data, nil
+}
+
+// Flushes and unmaps a window
+func (cache *windowCache) evict(elem *list.Element) error {
+	w := cache.lru.Remove(elem).(*window)
+	delete(cache.byIndex, w.index)
+
+	if err := w.data.Flush(); err != nil {
+		w.data.Unmap()
+		return err
+	}
+	return w.data.Unmap()
+}
+
+// Flushes every mapped window
+func (cache *windowCache) flush() error {
+	for elem := cache.lru.Front(); elem != nil; elem = elem.Next() {
+		if err := elem.Value.(*window).data.Flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Flushes and unmaps every window
+func (cache *windowCache) unmap() error {
+	var result error
+	for cache.lru.Len() > 0 {
+		if err := cache.evict(cache.lru.Front()); err != nil && result == nil {
+			result = err
+		}
+	}
+	return result
+}
+
+// Copies between data and the file starting at offset, header
+// included, through the windows it spans
+func (mFile *mmapFileImpl) copyWindows(offset int64, data []byte, write bool) error {
+	size := mFile.windows.size
+	for done := 0; done < len(data); {
+		at := offset + int64(done)
+
+		w, err := mFile.window(at / size)
+		if err != nil {
+			return err
+		} else if at%size >= int64(len(w)) {
+			return io.ErrUnexpectedEOF
+		}
+
+		if write {
+			done += copy(w[at%size:], data[done:])
+		} else {
+			done += copy(data[done:], w[at%size:])
+		}
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package osfs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
+	"github.com/deathly809/gomath"
+)
+
+// An open handle to a file in the directory
+type file struct {
+	fs      *fileSystemImpl
+	name    string
+	file    *os.File
+	isnew   bool
+	deleted bool // the file was deleted while the handle was open
+	status  int
+}
+
+// Returns an error if the handle or the file system is closed
+func (f *file) check() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return errors.New("File is closed")
+	} else if f.fs.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+	return nil
+}
+
+func (f *file) Close() error {
+	f.fs.lock.Lock()
+	defer f.fs.lock.Unlock()
+
+	if f.status == fsutil.Closed {
+		return errors.New("File already closed")
+	}
+	f.status = fsutil.Closed
+
+	if f.fs.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+	f.fs.unlock(f)
+	f.fs.closeHandle(f)
+
+	return f.file.Close()
+}
+
+func (f *file) Write(data []byte) (int, error) {
+	if data == nil {
+		return 0, errors.New("Null pointer exception")
+	} else if err := f.check(); err != nil {
+		return 0, err
+	} else if err = f.fs.beginIO(f); err != nil {
+		return 0, err
+	}
+	defer f.fs.endIO()
+
+	return f.file.Write(data)
+}
+
+// Publish writes the data at the position of the handle so that the
+// file has either all of it or none of it.  If the host fails part
+// way the bytes already overwritten are put back and the file is cut
+// to its old size.  The host writes in place, so only a crash part
+// way can leave a mix of both.
+func (f *file) Publish(data []byte) (int, error) {
+	if data == nil {
+		return 0, errors.New("Null pointer exception")
+	} else if err := f.check(); err != nil {
+		return 0, err
+	} else if err = f.fs.beginIO(f); err != nil {
+		return 0, err
+	}
+	defer f.fs.endIO()
+
+	pos, err := f.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	old := make([]byte, gomath.MaxInt64(0, gomath.MinInt64(int64(len(data)), info.Size()-pos)))
+	if _, err = f.file.ReadAt(old, pos); err != nil {
+		return 0, err
+	}
+
+	n, err := f.file.WriteAt(data, pos)
+	if err != nil {
+		if _, e := f.file.WriteAt(old, pos); e != nil {
+			return 0, e
+		} else if e = f.file.Truncate(info.Size()); e != nil {
+			return 0, e
+		}
+		return 0, err
+	}
+
+	_, err = f.file.Seek(pos+int64(n), io.SeekStart)
+	return n, err
+}
+
+// Read data into a given byte array
+// If the array is null an error is returned
+func (f *file) Read(data []byte) (int, error) {
+	if data == nil {
+		return 0, errors.New("Null pointer exception")
+	} else if err := f.check(); err != nil {
+		return 0, err
+	} else if err = f.fs.beginIO(f); err != nil {
+		return 0, err
+	}
+	defer f.fs.endIO()
+
+	return f.file.Read(data)
+}
+
+// Seek will move to a specific spot in the file.  If the
+// spot is not within the file it is clamped to either the
+// beginning or the end of the file.
+func (f *file) Seek(offset int64, from int) (int64, error) {
+	var base int64
+
+	if err := f.check(); err != nil {
+		return 0, err
+	}
+
+	pos, err := f.file.Seek(0, os.SEEK_CUR)
+	if err != nil {
+		return 0, err
+	}
+
+	size := f.Size()
+	switch gofs.FileOffset(from) {
+	case gofs.Beginning:
+		base = 0
+	case gofs.Current:
+		base = pos
+	case gofs.End:
+		base = size
+	default:
+		return pos, fmt.Errorf("invalid seek origin: %d", from)
+	}
+
+	return f.file.Seek(gomath.MaxInt64(0, gomath.MinInt64(base+offset, size)), os.SEEK_SET)
+}
+
+func (f *file) IsNew() bool {
+	return f.isnew
+}
+
+func (f *file) Name() string {
+	return f.name
+}
+
+func (f *file) Size() int64 {
+	info, err := f.file.Stat()
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
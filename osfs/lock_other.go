@@ -0,0 +1,15 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !openbsd && !solaris && !netbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!openbsd,!solaris,!netbsd
+
+package osfs
+
+import "os"
+
+// Locks on this host are only seen inside the process
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,25 @@
+//go:build darwin || dragonfly || freebsd || linux || openbsd || solaris || netbsd
+// +build darwin dragonfly freebsd linux openbsd solaris netbsd
+
+package osfs
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Takes an exclusive flock on the file, waiting for other
+// processes to release theirs
+func lockFile(f *os.File) error {
+	for {
+		err := unix.Flock(int(f.Fd()), unix.LOCK_EX)
+		if err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+func unlockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_UN)
+}
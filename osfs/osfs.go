@@ -0,0 +1,435 @@
+// Package osfs contains a gofs.FileSystem whose files are plain
+// files in a directory on the host.
+//
+// Names are paths relative to the root directory and may not leave
+// it.  Locks are held both inside the process and, where the host
+// supports it, with flock so other processes using the directory
+// see them too.
+package osfs
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/internal/fsutil"
+)
+
+type fileSystemImpl struct {
+	root      string             // the directory holding the files
+	openFiles map[string][]*file // the open handles of each file
+	state     *fsutil.State      // locks, I/O in progress and safe readers and writers
+	lock      *sync.Mutex        // guards everything above
+}
+
+// Open returns a file system rooted at the directory, creating
+// the directory if it does not exist
+func Open(root string) (gofs.FileSystem, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	} else if err = os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	} else if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+
+	result := &fileSystemImpl{
+		root:      root,
+		openFiles: make(map[string][]*file),
+		lock:      &sync.Mutex{},
+	}
+	result.state = fsutil.NewState(result.lock)
+	return result, nil
+}
+
+// Returns the cleaned name of the file and its path on the host.
+// Names which are empty or leave the root, directly or through a
+// symbolic link, are not valid.
+func (fSys *fileSystemImpl) resolve(filename string) (name, path string, ok bool) {
+	clean := filepath.Clean(filepath.FromSlash(filename))
+	if len(filename) == 0 || clean == "." || filepath.IsAbs(clean) || leaves(clean) {
+		return "", "", false
+	}
+
+	path, err := realPath(filepath.Join(fSys.root, clean))
+	if err != nil {
+		return "", "", false
+	} else if rel, err := filepath.Rel(fSys.root, path); err != nil || rel == "." || leaves(rel) {
+		return "", "", false
+	}
+	return filepath.ToSlash(clean), path, true
+}
+
+// Returns whether the relative path leaves the directory it is
+// relative to
+func leaves(rel string) bool {
+	return rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// Returns the path with the symbolic links in the part of it which
+// exists resolved.  A link to something which does not exist cannot
+// be resolved and is an error.
+func realPath(path string) (string, error) {
+	rest := ""
+	for {
+		real, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(real, rest), nil
+		} else if !os.IsNotExist(err) {
+			return "", err
+		} else if _, lerr := os.Lstat(path); lerr == nil {
+			return "", err
+		}
+
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
+
+func (fSys *fileSystemImpl) GetSafeWriter(file gofs.File) io.Writer {
+	return fSys.state.SafeWriter(file)
+}
+
+func (fSys *fileSystemImpl) GetSafeReader(file gofs.File) io.Reader {
+	return fSys.state.SafeReader(file)
+}
+
+// Waits until the file may be read or written by the handle and
+// records the I/O as in progress.  The I/O itself happens without
+// the lock and must be followed by a call to endIO.
+func (fSys *fileSystemImpl) beginIO(f *file) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+	return fSys.state.BeginIO(f)
+}
+
+func (fSys *fileSystemImpl) endIO() {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	fSys.state.EndIO()
+	if fSys.state.Status == fsutil.Closed && fSys.state.InFlight() == 0 {
+		fSys.closeFiles()
+	}
+}
+
+// Shutdown waits for reads and writes to finish and locks to be
+// released, then closes the files of the open handles.  If the
+// context expires first the files still being read or written are
+// closed once the last of that I/O finishes, and any error closing
+// them is lost.
+func (fSys *fileSystemImpl) Shutdown(ctx context.Context) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	return fSys.state.Shutdown(ctx, func() error {
+		if fSys.state.InFlight() > 0 {
+			return nil
+		}
+		return fSys.closeFiles()
+	})
+}
+
+// Closes the files of the open handles
+func (fSys *fileSystemImpl) closeFiles() error {
+	var err error
+	for _, handles := range fSys.openFiles {
+		for _, handle := range handles {
+			if e := handle.file.Close(); err == nil {
+				err = e
+			}
+		}
+	}
+	fSys.openFiles = make(map[string][]*file)
+	return err
+}
+
+// Lock waits until no other handle holds the lock on the file and
+// then takes the host lock on it, which may mean waiting on other
+// processes as well
+func (fSys *fileSystemImpl) Lock(f gofs.File) {
+	handle, ok := f.(*file)
+	if !ok || handle == nil {
+		return
+	}
+
+	// A deleted file has no name left to lock
+	fSys.lock.Lock()
+	locked := !handle.deleted && fSys.state.Lock(handle)
+	fSys.lock.Unlock()
+
+	if locked {
+		if err := lockFile(handle.file); err != nil {
+			fSys.Unlock(f)
+		}
+	}
+}
+
+func (fSys *fileSystemImpl) Unlock(file gofs.File) {
+	if file == nil {
+		return
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	fSys.unlock(file)
+}
+
+// Releases the lock on the file if it is held by the handle
+func (fSys *fileSystemImpl) unlock(f gofs.File) {
+	if fSys.state.Unlock(f) {
+		unlockFile(f.(*file).file)
+	}
+}
+
+func (fSys *fileSystemImpl) Open(filename string) gofs.File {
+	name, path, ok := fSys.resolve(filename)
+	if !ok {
+		return nil
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status != fsutil.Open {
+		return nil
+	} else if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil
+	}
+
+	isnew := true
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if os.IsExist(err) {
+		isnew = false
+		f, err = os.OpenFile(path, os.O_RDWR, 0)
+	}
+	if err != nil {
+		return nil
+	}
+
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		f.Close()
+		return nil
+	}
+
+	handle := &file{
+		fs:     fSys,
+		name:   name,
+		file:   f,
+		isnew:  isnew,
+		status: fsutil.Open,
+	}
+	fSys.openFiles[name] = append(fSys.openFiles[name], handle)
+
+	return handle
+}
+
+// Removes the handle from the open file table
+func (fSys *fileSystemImpl) closeHandle(handle *file) {
+	handles := fSys.openFiles[handle.name]
+	for i, h := range handles {
+		if h == handle {
+			handles = append(handles[:i], handles[i+1:]...)
+			break
+		}
+	}
+
+	if len(handles) > 0 {
+		fSys.openFiles[handle.name] = handles
+	} else {
+		// Safe readers and writers of the name have no handle left
+		delete(fSys.openFiles, handle.name)
+		fSys.state.ReleaseGuard(handle.name)
+	}
+}
+
+// Returns information about the regular file with the name
+func (fSys *fileSystemImpl) stat(filename string) (string, os.FileInfo) {
+	name, path, ok := fSys.resolve(filename)
+	if !ok {
+		return "", nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", nil
+	}
+	return name, info
+}
+
+func (fSys *fileSystemImpl) Exists(filename string) bool {
+	if fSys.state.IsClosed() {
+		return false
+	}
+
+	_, info := fSys.stat(filename)
+	return info != nil
+}
+
+// Delete removes the file from the directory.  Open handles keep
+// the contents where the host allows it.
+func (fSys *fileSystemImpl) Delete(filename string) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+
+	name, path, ok := fSys.resolve(filename)
+	if !ok {
+		return os.ErrInvalid
+	}
+
+	// The handles now belong to a file without a name, so a lock
+	// they hold must not keep a new file with the name locked
+	for _, handle := range fSys.openFiles[name] {
+		handle.deleted = true
+		fSys.unlock(handle)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Stat returns information about the file.  Hosts do not agree on
+// how to find when a file was created so the time it was last
+// modified is given for both.
+func (fSys *fileSystemImpl) Stat(filename string) gofs.FileStats {
+	name, info := fSys.stat(filename)
+	if info == nil {
+		return nil
+	}
+
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return nil
+	}
+
+	handles := make([]gofs.File, 0, len(fSys.openFiles[name]))
+	for _, handle := range fSys.openFiles[name] {
+		if !handle.deleted {
+			handles = append(handles, handle)
+		}
+	}
+
+	return fsutil.NewFileStats(info.ModTime(), info.ModTime(), info.Size(), handles)
+}
+
+// Names returns the regular files below the root directory
+func (fSys *fileSystemImpl) Names() []string {
+	if fSys.state.IsClosed() {
+		return nil
+	}
+
+	var names []string
+	filepath.WalkDir(fSys.root, func(path string, entry fs.DirEntry, err error) error {
+		if err == nil && entry.Type().IsRegular() {
+			if rel, err := filepath.Rel(fSys.root, path); err == nil {
+				names = append(names, filepath.ToSlash(rel))
+			}
+		}
+		return nil
+	})
+
+	// Walked in lexical order of the host's paths, which need not
+	// be the order of the names
+	sort.Strings(names)
+	return names
+}
+
+func (fSys *fileSystemImpl) SetLastModified(filename string, t time.Time) error {
+	if fSys.state.IsClosed() {
+		return gofs.ErrClosed
+	}
+
+	_, info := fSys.stat(filename)
+	if info == nil {
+		return fmt.Errorf("file does not exist: %s", filename)
+	}
+
+	// The access time is left as it is
+	_, path, _ := fSys.resolve(filename)
+	return os.Chtimes(path, time.Time{}, t)
+}
+
+// Rename moves the file on the host.  Its handles and its lock move
+// with it, the handles of a file it replaces are left with a file
+// without a name as if it had been deleted.
+func (fSys *fileSystemImpl) Rename(oldName, newName string) error {
+	fSys.lock.Lock()
+	defer fSys.lock.Unlock()
+
+	if fSys.state.Status == fsutil.Closed {
+		return gofs.ErrClosed
+	}
+
+	from, oldPath, ok := fSys.resolve(oldName)
+	if !ok {
+		return os.ErrInvalid
+	}
+	to, newPath, ok := fSys.resolve(newName)
+	if !ok {
+		return os.ErrInvalid
+	} else if from == to {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		return err
+	} else if err = os.Rename(oldPath, newPath); err != nil {
+		return err
+	}
+
+	for _, handle := range fSys.openFiles[to] {
+		handle.deleted = true
+		fSys.unlock(handle)
+	}
+
+	// The host lock is on the file, only the name it is kept under
+	// changes
+	owner, locked := fSys.state.Owner(from)
+	if locked {
+		fSys.state.Unlock(owner)
+	}
+
+	var left []*file
+	for _, handle := range fSys.openFiles[from] {
+		if handle.deleted {
+			left = append(left, handle)
+		} else {
+			handle.name = to
+			fSys.openFiles[to] = append(fSys.openFiles[to], handle)
+		}
+	}
+
+	if len(left) > 0 {
+		fSys.openFiles[from] = left
+	} else {
+		delete(fSys.openFiles, from)
+		fSys.state.ReleaseGuard(from)
+	}
+
+	if locked {
+		fSys.state.Lock(owner)
+	}
+	return nil
+}
@@ -0,0 +1,346 @@
+package osfs
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/deathly809/gofs"
+	"github.com/deathly809/gofs/fstest"
+)
+
+var testData = []byte("asdfgasdfgasdfgasdfgasdfgasdfg")
+
+func testDir(t *testing.T) string {
+	dir := filepath.Join(os.TempDir(), "osfsdata")
+	os.RemoveAll(dir)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func TestReadWrite(t *testing.T) {
+	dir := testDir(t)
+	fs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	file := fs.Open("sub/test")
+	if file == nil || !file.IsNew() {
+		t.Fatal("could not create file")
+	}
+
+	if n, err := file.Write(testData); n != len(testData) || err != nil {
+		t.Error("did not write all data: ", err)
+	}
+
+	if file.Size() != int64(len(testData)) || fs.Stat("sub/test").Size() != len(testData) {
+		t.Error("incorrect size: ", file.Size())
+	}
+
+	if data, err := os.ReadFile(filepath.Join(dir, "sub", "test")); err != nil || !bytes.Equal(data, testData) {
+		t.Error("data not written to the directory: ", err)
+	}
+
+	if pos, _ := file.Seek(-10, int(gofs.Beginning)); pos != 0 {
+		t.Error("seek not clamped to the beginning: ", pos)
+	}
+
+	data := make([]byte, len(testData))
+	if n, err := file.Read(data); n != len(data) || err != nil {
+		t.Error("did not read all data: ", err)
+	} else if !bytes.Equal(data, testData) {
+		t.Error("data not the same")
+	}
+
+	if _, err := file.Read(data); err != io.EOF {
+		t.Error("expected io.EOF at the end of the file: ", err)
+	}
+
+	if pos, _ := file.Seek(10, int(gofs.End)); pos != int64(len(testData)) {
+		t.Error("seek not clamped to the end: ", pos)
+	}
+
+	if err := file.Close(); err != nil {
+		t.Error(err)
+	} else if err := file.Close(); err == nil {
+		t.Error("closed a file twice")
+	}
+
+	other := fs.Open("sub/../sub/test")
+	if other == nil || other.IsNew() || other.Name() != "sub/test" {
+		t.Error("existing file not opened")
+	}
+	other.Close()
+}
+
+func TestNames(t *testing.T) {
+	fs, err := Open(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	for _, name := range []string{"", ".", "..", "../escape", "/abs", "sub/../../escape"} {
+		if file := fs.Open(name); file != nil {
+			file.Close()
+			t.Error("opened a file outside the root: ", name)
+		}
+	}
+
+	fs.Open("sub/test").Close()
+	if fs.Open("sub") != nil || fs.Exists("sub") {
+		t.Error("directory treated as a file")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	fs, err := Open(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	file := fs.Open("test")
+	file.Write(testData)
+
+	if err := fs.Delete("test"); err != nil {
+		t.Error(err)
+	}
+
+	if fs.Exists("test") || fs.Stat("test") != nil {
+		t.Error("file still exists after delete")
+	}
+
+	again := fs.Open("test")
+	if !again.IsNew() || len(fs.Stat("test").Handles()) != 1 {
+		t.Error("deleted file was not replaced by a new one")
+	}
+
+	again.Close()
+	file.Close()
+}
+
+func TestDelete_Locked(t *testing.T) {
+	fs, err := Open(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	old := fs.Open("test")
+	fs.Lock(old)
+	fs.Delete("test")
+
+	// The lock of the deleted file does not hold up the new one
+	file := fs.Open("test")
+	written := make(chan struct{})
+	go func() {
+		file.Write(testData)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Error("new file locked by a handle of the deleted one")
+		fs.Unlock(old)
+		<-written
+	}
+
+	old.Close()
+	file.Close()
+}
+
+func TestSymlinks(t *testing.T) {
+	dir := testDir(t)
+	outside := t.TempDir()
+	fs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	if err = os.WriteFile(filepath.Join(outside, "secret"), testData, 0644); err != nil {
+		t.Fatal(err)
+	} else if err = os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+		t.Skip("cannot create symbolic links: ", err)
+	}
+	os.Symlink(filepath.Join(outside, "missing"), filepath.Join(dir, "dangling"))
+	os.Mkdir(filepath.Join(dir, "in"), 0755)
+	os.Symlink(filepath.Join(dir, "in"), filepath.Join(dir, "link"))
+
+	for _, name := range []string{"out/secret", "out/new", "out/sub/new", "dangling"} {
+		if fs.Open(name) != nil || fs.Exists(name) || fs.Stat(name) != nil {
+			t.Errorf("%s followed out of the root", name)
+		} else if err = fs.Delete(name); err == nil {
+			t.Errorf("deleted %s", name)
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(outside, "secret")); err != nil {
+		t.Error("file outside the root was removed")
+	} else if entries, _ := os.ReadDir(outside); len(entries) != 1 {
+		t.Errorf("%d files created outside the root", len(entries)-1)
+	}
+
+	// Links which stay inside the root are followed
+	if file := fs.Open("link/test"); file == nil {
+		t.Error("could not open a file through a link inside the root")
+	} else {
+		file.Close()
+	}
+	if !fs.Exists("in/test") {
+		t.Error("file not created through the link")
+	}
+}
+
+func TestLock(t *testing.T) {
+	fs, err := Open(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	owner := fs.Open("test")
+	other := fs.Open("test")
+
+	fs.Lock(owner)
+
+	written := make(chan struct{})
+	go func() {
+		other.Write(testData)
+		close(written)
+	}()
+
+	select {
+	case <-written:
+		t.Error("wrote to a file locked by another handle")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Unlocking with the wrong handle does nothing
+	fs.Unlock(other)
+	select {
+	case <-written:
+		t.Error("lock released by a handle which does not hold it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fs.Unlock(owner)
+	<-written
+
+	// The host lock was released so another handle can take it
+	fs.Lock(other)
+	fs.Unlock(other)
+
+	owner.Close()
+	other.Close()
+}
+
+func TestRename(t *testing.T) {
+	fs, err := Open(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	moved := fs.Open("a")
+	moved.Write(testData)
+	fs.Lock(moved)
+	replaced := fs.Open("sub/b")
+
+	if err := fs.(gofs.Renamer).Rename("a", "sub/b"); err != nil {
+		t.Fatal(err)
+	} else if fs.Exists("a") {
+		t.Error("a exists after the rename")
+	}
+
+	// The handles and the lock of a follow it
+	handles := fs.Stat("sub/b").Handles()
+	if moved.Name() != "sub/b" || len(handles) != 1 || handles[0] != moved {
+		t.Errorf("handles of sub/b are %v", handles)
+	} else if owner, _ := fs.(*fileSystemImpl).state.Owner("sub/b"); owner != moved {
+		t.Error("the lock did not move with the file")
+	}
+
+	moved.Seek(0, int(gofs.Beginning))
+	data := make([]byte, len(testData))
+	if _, err := io.ReadFull(moved, data); err != nil || !bytes.Equal(data, testData) {
+		t.Error("read the wrong data after the rename: ", err)
+	}
+
+	if err := fs.(gofs.Renamer).Rename("missing", "c"); err == nil {
+		t.Error("renamed a file which does not exist")
+	}
+
+	fs.Unlock(moved)
+	moved.Close()
+	replaced.Close()
+}
+
+func TestShutdown(t *testing.T) {
+	fs, err := Open(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := fs.Open("test")
+
+	if err := fs.Shutdown(context.Background()); err != nil {
+		t.Error(err)
+	}
+
+	if fs.Open("test") != nil || fs.Exists("test") || fs.Stat("test") != nil {
+		t.Error("file system still usable after shutdown")
+	}
+
+	if _, err := file.Write(testData); err != gofs.ErrClosed {
+		t.Error("expected ErrClosed: ", err)
+	}
+
+	if err := fs.Shutdown(context.Background()); err != gofs.ErrClosed {
+		t.Error("shut down twice")
+	}
+}
+
+func TestSafeGuards(t *testing.T) {
+	fs, err := Open(testDir(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Shutdown(context.Background())
+
+	file := fs.Open("test")
+	fs.GetSafeWriter(file)
+	if err := fs.Delete("test"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Kept while a handle on the name is open, even a deleted one
+	again := fs.Open("test")
+	fs.GetSafeReader(again)
+	again.Close()
+	if guards := fs.(*fileSystemImpl).state.Guards(); guards != 1 {
+		t.Errorf("%d guards while a handle is open", guards)
+	}
+
+	file.Close()
+	if guards := fs.(*fileSystemImpl).state.Guards(); guards != 0 {
+		t.Errorf("%d guards after the last handle was closed", guards)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	fstest.TestFileSystem(t, func() gofs.FileSystem {
+		fs, err := Open(t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs
+	})
+}
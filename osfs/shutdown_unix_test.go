@@ -0,0 +1,68 @@
+//go:build darwin || dragonfly || freebsd || linux || openbsd || solaris || netbsd
+// +build darwin dragonfly freebsd linux openbsd solaris netbsd
+
+package osfs
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestShutdown_Deadline(t *testing.T) {
+	dir := testDir(t)
+	fs, err := Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reading a pipe waits until something is written to it
+	path := filepath.Join(dir, "pipe")
+	if err = unix.Mkfifo(path, 0644); err != nil {
+		t.Skip("cannot create a pipe: ", err)
+	}
+	handle := fs.Open("pipe")
+	if handle == nil {
+		t.Fatal("could not open the pipe")
+	}
+
+	type result struct {
+		n   int
+		err error
+	}
+	read := make(chan result)
+	go func() {
+		n, err := handle.Read(make([]byte, len(testData)))
+		read <- result{n, err}
+	}()
+	time.Sleep(50 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err = fs.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("shutdown returned %v", err)
+	}
+
+	// The read still has its file once the shutdown gives up on it,
+	// otherwise the pipe has no reader and cannot be opened
+	writer, err := os.OpenFile(path, os.O_WRONLY|unix.O_NONBLOCK, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer writer.Close()
+	writer.Write(testData)
+
+	if r := <-read; r.err != nil || r.n != len(testData) {
+		t.Errorf("read %d bytes: %v", r.n, r.err)
+	}
+
+	// and it is closed once the read is done
+	if err = handle.(*file).file.Close(); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("file left open after the read: %v", err)
+	}
+}
@@ -1,28 +1,31 @@
-//
-//	TODO: Think about this a lot.  Do we want to have the FileSystem
-//	create and return a SafeReader?
-//
-
 package readers
 
 import (
-    "io"
- "github.com/deathly809/gofs"   
-)        
+	"io"
+
+	"github.com/deathly809/gofs"
+)
 
 type fileReader struct {
-	file gofs.File
+	file  gofs.File
+	guard *Guard
 }
 
+// Read fills p from the file.  If a write is being published the
+// read waits for it to complete before reading.
 func (reader *fileReader) Read(p []byte) (int, error) {
-	return reader.file.Read(p)
+	reader.guard.beginRead()
+	defer reader.guard.endRead()
 
+	return reader.file.Read(p)
 }
 
-// NewSafeReader takes in a File object and returns a reader that
-// allows users to write to the file
-func NewSafeReader(f gofs.File) io.Reader {
+// NewSafeReader takes in a File object and the Guard shared by the
+// file's readers and writers and returns a reader that allows users
+// to read consistent data from the file
+func NewSafeReader(f gofs.File, g *Guard) io.Reader {
 	result := new(fileReader)
 	result.file = f
+	result.guard = g
 	return result
 }
@@ -1,8 +1,3 @@
-//
-//	TODO: Think about this a lot.  Do we want to have the FileSystem
-//	create and return a SafeWriter?
-//
-
 package readers
 
 import (
@@ -11,18 +6,45 @@ import (
 	"github.com/deathly809/gofs"
 )
 
+// Publisher is implemented by files which can write data so that
+// the file has either all of it or none of it, even when the write
+// fails part way
+type Publisher interface {
+	Publish(data []byte) (int, error)
+}
+
 type fileWriter struct {
-	file fs.File
+	file  gofs.File
+	guard *Guard
 }
 
+// Write stages a copy of data and publishes it to the file once
+// all reads in progress have completed.  Reads started after the
+// write are blocked until it has been published.  A file which is a
+// Publisher publishes the data whole or not at all, any other file
+// is written with Write.
 func (writer *fileWriter) Write(data []byte) (written int, err error) {
-	return writer.file.Write(data)
+	if data == nil {
+		return writer.file.Write(data)
+	}
+	staged := make([]byte, len(data))
+	copy(staged, data)
+
+	writer.guard.beginWrite()
+	defer writer.guard.endWrite()
+
+	if publisher, ok := writer.file.(Publisher); ok {
+		return publisher.Publish(staged)
+	}
+	return writer.file.Write(staged)
 }
 
-// NewSafeWriter takes in a File object and returns a writer that
-// allows users to Write to the file
-func NewSafeWriter(f gofs.File) io.Writer {
+// NewSafeWriter takes in a File object and the Guard shared by the
+// file's readers and writers and returns a writer that allows users
+// to Write to the file atomically
+func NewSafeWriter(f gofs.File, g *Guard) io.Writer {
 	result := new(fileWriter)
 	result.file = f
+	result.guard = g
 	return result
 }
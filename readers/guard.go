@@ -0,0 +1,69 @@
+// Package readers contains the safe readers and writers handed out
+// by a FileSystem.
+//
+// Every file has a single Guard shared by all of its safe readers
+// and writers.  A writer stages the data it is given and publishes
+// it while no reads are in progress, and a reader only reads while
+// no write is being published.  A reader therefore sees either the
+// contents before a write or after it, never a mix of both.
+//
+// Files which are a Publisher also keep a write which fails part way
+// out of the file, so the contents are never a mix of both on disk
+// either.
+package readers
+
+import "sync"
+
+// Guard coordinates the safe readers and writers of a single file
+type Guard struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	readers int  // reads in progress
+	waiting int  // writers waiting to publish
+	writing bool // a write is being published
+}
+
+// NewGuard returns a Guard with no reads or writes in progress
+func NewGuard() *Guard {
+	result := &Guard{}
+	result.cond = sync.NewCond(&result.lock)
+	return result
+}
+
+// beginRead blocks while a write is waiting or being published and
+// then records a read in progress
+func (g *Guard) beginRead() {
+	g.lock.Lock()
+	for g.writing || g.waiting > 0 {
+		g.cond.Wait()
+	}
+	g.readers++
+	g.lock.Unlock()
+}
+
+func (g *Guard) endRead() {
+	g.lock.Lock()
+	g.readers--
+	g.cond.Broadcast()
+	g.lock.Unlock()
+}
+
+// beginWrite blocks new reads, waits for the reads in progress to
+// complete and then records a write being published
+func (g *Guard) beginWrite() {
+	g.lock.Lock()
+	g.waiting++
+	for g.writing || g.readers > 0 {
+		g.cond.Wait()
+	}
+	g.waiting--
+	g.writing = true
+	g.lock.Unlock()
+}
+
+func (g *Guard) endWrite() {
+	g.lock.Lock()
+	g.writing = false
+	g.cond.Broadcast()
+	g.lock.Unlock()
+}